@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+
+	asnutil "github.com/libp2p/go-libp2p-asn-util"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// PeerAddress is an underlay address of a peer, classified by network and transport.
+type PeerAddress struct {
+	Addr string
+	// IPVersion is 4 or 6, or 0 if the address does not contain an IP (e.g. DNS addresses).
+	IPVersion int
+	IP        string
+	// Transport is the outermost transport protocol of the connection, e.g. tcp, quic, quic-v1 or webtransport.
+	// For relayed connections, this is the transport to the relay.
+	Transport string
+	// Relay is whether the peer was connected through a circuit relay.
+	Relay bool
+	// ASN is the autonomous system of the IP, if known. The embedded table of go-libp2p-asn-util only covers IPv6.
+	ASN string
+}
+
+// transportRank orders transport protocols from the innermost to the outermost layer.
+var transportRank = map[int]int{
+	multiaddr.P_UDP:          1,
+	multiaddr.P_TCP:          1,
+	multiaddr.P_QUIC:         2,
+	multiaddr.P_QUIC_V1:      2,
+	multiaddr.P_WS:           2,
+	multiaddr.P_WSS:          2,
+	multiaddr.P_WEBTRANSPORT: 3,
+}
+
+// ParsePeerAddress parses and classifies a multiaddr. The ASN is annotated offline.
+func ParsePeerAddress(addr string) (*PeerAddress, error) {
+	ma, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	pa := &PeerAddress{Addr: addr}
+	rank := 0
+	for _, p := range ma.Protocols() {
+		switch p.Code {
+		case multiaddr.P_CIRCUIT:
+			pa.Relay = true
+		case multiaddr.P_IP4, multiaddr.P_IP6:
+			if pa.IP != "" {
+				continue
+			}
+			pa.IP, _ = ma.ValueForProtocol(p.Code)
+			pa.IPVersion = 4
+			if p.Code == multiaddr.P_IP6 {
+				pa.IPVersion = 6
+			}
+		default:
+			if r := transportRank[p.Code]; !pa.Relay && r > rank {
+				pa.Transport, rank = p.Name, r
+			}
+		}
+	}
+
+	if pa.IPVersion == 6 {
+		if asn, err := asnutil.Store.AsnForIPv6(net.ParseIP(pa.IP)); err == nil {
+			pa.ASN = asn
+		}
+	}
+	return pa, nil
+}
+
+// Properties returns the graph properties of the address.
+func (pa *PeerAddress) Properties() map[string]interface{} {
+	props := map[string]interface{}{
+		"addr":       pa.Addr,
+		"ip_version": pa.IPVersion,
+		"transport":  pa.Transport,
+		"relay":      pa.Relay,
+	}
+	if pa.IP != "" {
+		props["ip"] = pa.IP
+	}
+	if pa.ASN != "" {
+		props["asn"] = pa.ASN
+	}
+	return props
+}
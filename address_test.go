@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePeerAddress(t *testing.T) {
+	t.Run("IPv4 TCP", func(t *testing.T) {
+		pa, err := ParsePeerAddress("/ip4/147.75.80.110/tcp/4001")
+		assert.Nil(t, err)
+		assert.Equal(t, 4, pa.IPVersion)
+		assert.Equal(t, "147.75.80.110", pa.IP)
+		assert.Equal(t, "tcp", pa.Transport)
+		assert.False(t, pa.Relay)
+		assert.Empty(t, pa.ASN)
+	})
+
+	t.Run("IPv6 QUIC with ASN", func(t *testing.T) {
+		pa, err := ParsePeerAddress("/ip6/2604:1380:4642:6600::3/udp/4001/quic")
+		assert.Nil(t, err)
+		assert.Equal(t, 6, pa.IPVersion)
+		assert.Equal(t, "quic", pa.Transport)
+		assert.NotEmpty(t, pa.ASN)
+	})
+
+	t.Run("relayed", func(t *testing.T) {
+		pa, err := ParsePeerAddress("/ip4/1.2.3.4/udp/4001/quic-v1/p2p/12D3KooWDpJ7As7BWAwRMfu1VU2WCqNjvq387JEYKDBj4kx6nXTN/p2p-circuit")
+		assert.Nil(t, err)
+		assert.True(t, pa.Relay)
+		assert.Equal(t, "quic-v1", pa.Transport)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParsePeerAddress("not a multiaddr")
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Reasons for which a traversal is truncated (property truncated_by of the root).
+const (
+	TruncatedByDepth    = "depth"
+	TruncatedByBlocks   = "blocks"
+	TruncatedByBytes    = "bytes"
+	TruncatedByDuration = "duration"
+)
+
+// Budget limits the traversal of a single root. Zero values are unlimited.
+type Budget struct {
+	// MaxDepth is the maximum distance of a block from the root.
+	MaxDepth int
+	// MaxBlocks is the maximum number of blocks that are retrieved.
+	MaxBlocks int
+	// MaxBytes is the maximum number of bytes of block data that are retrieved.
+	MaxBytes int64
+	// MaxDuration is the wall-clock time after which no further blocks are visited.
+	MaxDuration time.Duration
+}
+
+// traversal tracks the spending of a root's budget.
+type traversal struct {
+	root    cid.Cid
+	monitor string
+	// requested is set if the root was requested in a wantlist (see traversalRoot).
+	requested bool
+	budget    Budget
+	deadline  time.Time
+
+	mu          sync.Mutex
+	blocks      int
+	bytes       int64
+	truncatedBy string
+	// files are the root and the directory entries reached by the traversal.
+	files *Set[cid.Cid]
+	// failed are the blocks that failed during the traversal, which it does not retrieve again.
+	failed *Set[cid.Cid]
+}
+
+func newTraversal(monitor string, budget Budget) *traversal {
+	t := &traversal{monitor: monitor, budget: budget, files: NewSet[cid.Cid](), failed: NewSet[cid.Cid]()}
+	if budget.MaxDuration > 0 {
+		t.deadline = time.Now().Add(budget.MaxDuration)
+	}
+	return t
+}
+
+// admit reports whether a block may be visited within the budget. Once a limit is hit, the traversal is
+// truncated and no further blocks (except shallower ones in case of the depth limit) are admitted.
+func (t *traversal) admit(v visit) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	reason := ""
+	switch {
+	case t.budget.MaxDepth > 0 && v.depth > t.budget.MaxDepth:
+		reason = TruncatedByDepth
+	case t.budget.MaxBlocks > 0 && t.blocks >= t.budget.MaxBlocks:
+		reason = TruncatedByBlocks
+	case t.budget.MaxBytes > 0 && t.bytes >= t.budget.MaxBytes:
+		reason = TruncatedByBytes
+	case !t.deadline.IsZero() && time.Now().After(t.deadline):
+		reason = TruncatedByDuration
+	}
+	if reason != "" && t.truncatedBy == "" {
+		t.truncatedBy = reason
+	}
+	return reason == ""
+}
+
+// reserve accounts for a block that is about to be retrieved from IPFS. It reports false, truncating the
+// traversal, if the block limit has been reached. Checking and counting in one step keeps concurrent workers
+// from exceeding the limit.
+func (t *traversal) reserve() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.budget.MaxBlocks > 0 && t.blocks >= t.budget.MaxBlocks {
+		if t.truncatedBy == "" {
+			t.truncatedBy = TruncatedByBlocks
+		}
+		return false
+	}
+	t.blocks++
+	return true
+}
+
+// retrieved accounts for the n bytes of a block that was retrieved from IPFS.
+func (t *traversal) retrieved(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bytes += int64(n)
+}
+
+// fail records that the retrieval of a block failed during the traversal.
+func (t *traversal) fail(_cid cid.Cid) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failed.Add(_cid)
+}
+
+// hasFailed reports whether the retrieval of a block failed during the traversal.
+func (t *traversal) hasFailed(_cid cid.Cid) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failed.Has(_cid)
+}
+
+// truncated returns the reason for which the traversal was truncated, or "" if it was not.
+func (t *traversal) truncated() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.truncatedBy
+}
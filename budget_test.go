@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraversal_Admit(t *testing.T) {
+	t.Run("unlimited", func(t *testing.T) {
+		tr := newTraversal("", Budget{})
+		for i := 0; i < 100; i++ {
+			tr.reserve()
+			tr.retrieved(1 << 20)
+		}
+		assert.True(t, tr.admit(visit{depth: 100}))
+		assert.Equal(t, "", tr.truncated())
+	})
+
+	t.Run("depth", func(t *testing.T) {
+		tr := newTraversal("", Budget{MaxDepth: 2})
+		assert.True(t, tr.admit(visit{depth: 2}))
+		assert.False(t, tr.admit(visit{depth: 3}))
+		// shallower blocks are still visited
+		assert.True(t, tr.admit(visit{depth: 1}))
+		assert.Equal(t, TruncatedByDepth, tr.truncated())
+	})
+
+	t.Run("blocks", func(t *testing.T) {
+		tr := newTraversal("", Budget{MaxBlocks: 2})
+		assert.True(t, tr.reserve())
+		assert.True(t, tr.admit(visit{}))
+		assert.True(t, tr.reserve())
+		assert.False(t, tr.admit(visit{}))
+		assert.False(t, tr.reserve())
+		assert.Equal(t, TruncatedByBlocks, tr.truncated())
+	})
+
+	t.Run("blocks reserved concurrently", func(t *testing.T) {
+		tr := newTraversal("", Budget{MaxBlocks: 5})
+		var reserved int64
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if tr.admit(visit{}) && tr.reserve() {
+					atomic.AddInt64(&reserved, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int64(5), reserved)
+		assert.Equal(t, TruncatedByBlocks, tr.truncated())
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		tr := newTraversal("", Budget{MaxBytes: 100})
+		tr.retrieved(99)
+		assert.True(t, tr.admit(visit{}))
+		tr.retrieved(1)
+		assert.False(t, tr.admit(visit{}))
+		assert.Equal(t, TruncatedByBytes, tr.truncated())
+	})
+
+	t.Run("duration", func(t *testing.T) {
+		tr := newTraversal("", Budget{MaxDuration: time.Millisecond})
+		time.Sleep(2 * time.Millisecond)
+		assert.False(t, tr.admit(visit{}))
+		assert.Equal(t, TruncatedByDuration, tr.truncated())
+	})
+}
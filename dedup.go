@@ -0,0 +1,145 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/bbloom"
+	"github.com/ipfs/go-cid"
+)
+
+var (
+	// dedupHits counts requests for CIDs that were scheduled recently and hence not downloaded again.
+	dedupHits = expvar.NewInt("dedup_hits")
+	// dedupMisses counts requests for CIDs that were passed on to the fetcher.
+	dedupMisses = expvar.NewInt("dedup_misses")
+)
+
+// RequestDeduplicator sits in front of the fetcher and skips CIDs that have been scheduled recently, so that
+// popular CIDs do not cause a full Download round trip on every request.
+//
+// Every scheduled CID is admitted to a small window LRU right away, so that repeats shortly after the first request
+// are deduplicated. The main LRU holds the popular CIDs for longer: a bloom filter acts as its doorkeeper, so a CID
+// is only admitted to it once it has been requested before, which keeps CIDs that are requested only once from
+// evicting the popular ones. Requests are counted on the block nodes (requests property) in batches.
+//
+// CIDs whose traversal failed or was truncated, and CIDs that were dropped from the fetch queue, are forgotten
+// (see Forget), so that they are scheduled again when they are requested again.
+type RequestDeduplicator struct {
+	graph GraphQuerier
+
+	mu sync.Mutex
+	// window holds the most recently scheduled CIDs.
+	window *LRU[cid.Cid]
+	// recent holds the CIDs that were requested repeatedly.
+	recent     *LRU[cid.Cid]
+	doorkeeper *bbloom.Bloom
+	// doorkeeperCapacity is the number of CIDs after which the doorkeeper is reset to bound false positives.
+	doorkeeperCapacity uint64
+	flushInterval      time.Duration
+	lastFlush          time.Time
+	counts             map[cid.Cid]int
+}
+
+// NewRequestDeduplicator creates a RequestDeduplicator that remembers up to size recently scheduled CIDs and
+// writes pending request counts to graph at most every flushInterval. A tenth of size is used for the window.
+func NewRequestDeduplicator(graph GraphQuerier, size int, flushInterval time.Duration) *RequestDeduplicator {
+	capacity := uint64(10 * size)
+	doorkeeper, err := bbloom.New(float64(capacity), 0.01)
+	if err != nil {
+		panic(err)
+	}
+	windowSize := size / 10
+	if windowSize < 1 || size < 2 {
+		windowSize = 1
+		size = 2
+	}
+	return &RequestDeduplicator{
+		graph:              graph,
+		window:             NewLRU[cid.Cid](windowSize),
+		recent:             NewLRU[cid.Cid](size - windowSize),
+		doorkeeper:         doorkeeper,
+		doorkeeperCapacity: capacity,
+		flushInterval:      flushInterval,
+		lastFlush:          time.Now(),
+		counts:             map[cid.Cid]int{},
+	}
+}
+
+// Schedule counts a request for the CID and reports whether it needs to be passed on to the fetcher.
+func (d *RequestDeduplicator) Schedule(_cid cid.Cid) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.counts[_cid]++
+	if d.recent.Touch(_cid) {
+		dedupHits.Add(1)
+		return false
+	}
+
+	if d.doorkeeper.ElementsAdded() >= d.doorkeeperCapacity {
+		d.doorkeeper.Clear()
+	}
+	if !d.doorkeeper.AddIfNotHas(_cid.Bytes()) {
+		d.recent.Add(_cid)
+	}
+	if d.window.Touch(_cid) {
+		dedupHits.Add(1)
+		return false
+	}
+	d.window.Add(_cid)
+	dedupMisses.Add(1)
+	return true
+}
+
+// Forget removes a CID from the cache, such that the next request for it is passed on to the fetcher.
+func (d *RequestDeduplicator) Forget(_cid cid.Cid) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.window.Remove(_cid)
+	d.recent.Remove(_cid)
+}
+
+// MaybeFlush writes the pending request counts to the graph if the flush interval has passed.
+func (d *RequestDeduplicator) MaybeFlush() error {
+	d.mu.Lock()
+	due := time.Since(d.lastFlush) >= d.flushInterval
+	d.mu.Unlock()
+	if !due {
+		return nil
+	}
+	return d.Flush()
+}
+
+// Flush increments the requests counters of all blocks with pending requests in a single query.
+func (d *RequestDeduplicator) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastFlush = time.Now()
+	if len(d.counts) == 0 {
+		return nil
+	}
+	rows := make([]string, 0, len(d.counts))
+	for _cid, n := range d.counts {
+		node := newNode(_cid)
+		rows = append(rows, fmt.Sprintf(
+			"{cid: '%s', codec: '%s', n: %d}", node.GetProperty("cid"), node.GetProperty("codec"), n,
+		))
+	}
+	if _, err := d.graph.Query(
+		"UNWIND [" + strings.Join(rows, ", ") + "] AS c " +
+			"MERGE (b:Block {cid: c.cid, codec: c.codec}) " +
+			"SET b.requests = coalesce(b.requests, 0) + c.n",
+	); err != nil {
+		return err
+	}
+	d.counts = map[cid.Cid]int{}
+	return nil
+}
+
+// Close writes the pending request counts to the graph, such that no requests are lost on shutdown.
+func (d *RequestDeduplicator) Close() error {
+	return d.Flush()
+}
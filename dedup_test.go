@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/korovkin/limiter"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU(t *testing.T) {
+	lru := NewLRU[int](2)
+	lru.Add(1)
+	lru.Add(2)
+	assert.True(t, lru.Touch(1))
+	lru.Add(3)
+
+	assert.Equal(t, 2, lru.Size())
+	assert.True(t, lru.Touch(1))
+	assert.False(t, lru.Touch(2))
+	assert.True(t, lru.Touch(3))
+
+	lru.Remove(1)
+	lru.Remove(4)
+	assert.Equal(t, 1, lru.Size())
+	assert.False(t, lru.Touch(1))
+}
+
+func TestRequestDeduplicator_Schedule(t *testing.T) {
+	d := NewRequestDeduplicator(nil, 10, time.Hour)
+	popular, once := cid.MustParse(rawCID), cid.MustParse(otherRawCID)
+	hits, misses := dedupHits.Value(), dedupMisses.Value()
+
+	t.Run("CIDs requested once are only admitted to the window", func(t *testing.T) {
+		assert.True(t, d.Schedule(once))
+		assert.Equal(t, 1, d.window.Size())
+		assert.Equal(t, 0, d.recent.Size())
+	})
+
+	t.Run("repeated requests are deduplicated right away", func(t *testing.T) {
+		assert.True(t, d.Schedule(popular))
+		for i := 0; i < 6; i++ {
+			assert.False(t, d.Schedule(popular))
+		}
+		assert.Equal(t, 1, d.recent.Size())
+	})
+
+	t.Run("popular CIDs outlive the window", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			hash, err := mh.Sum([]byte{byte(i)}, mh.SHA2_256, -1)
+			assert.Nil(t, err)
+			assert.True(t, d.Schedule(cid.NewCidV1(cid.Raw, hash)))
+		}
+		assert.False(t, d.Schedule(popular))
+	})
+
+	t.Run("all requests are counted", func(t *testing.T) {
+		assert.Equal(t, 8, d.counts[popular])
+		assert.Equal(t, 1, d.counts[once])
+		assert.Equal(t, hits+7, dedupHits.Value())
+		assert.Equal(t, misses+7, dedupMisses.Value())
+	})
+}
+
+func TestRequestDeduplicator_Forget(t *testing.T) {
+	d := NewRequestDeduplicator(nil, 10, time.Hour)
+	c := cid.MustParse(rawCID)
+	assert.True(t, d.Schedule(c))
+	assert.False(t, d.Schedule(c))
+	assert.Equal(t, 1, d.recent.Size())
+
+	d.Forget(c)
+	assert.True(t, d.Schedule(c))
+	assert.False(t, d.Schedule(c))
+}
+
+func TestIPFSFetcher_DedupForget(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+
+	d := NewRequestDeduplicator(nil, 10, time.Hour)
+	fetcher := NewIPFSFetcher(context.Background(), &corruptIPFSNode{NewMockIPFSNode()}, graphPoolTest, ipfsTestDataPath,
+		FetchLimits{Workers: 2, Network: 2})
+	fetcher.Dedup = d
+
+	t.Run("roots of failed traversals are forgotten", func(t *testing.T) {
+		assert.True(t, d.Schedule(cid.MustParse(fileCID)))
+		jobs = limiter.NewConcurrencyLimiter(1)
+		fetcher.Download(cid.MustParse(fileCID), "")
+		jobs.WaitAndClose()
+		assert.True(t, d.Schedule(cid.MustParse(fileCID)))
+	})
+
+	t.Run("roots of complete traversals are kept", func(t *testing.T) {
+		assert.True(t, d.Schedule(cid.MustParse(rawCID)))
+		jobs = limiter.NewConcurrencyLimiter(1)
+		fetcher.Download(cid.MustParse(rawCID), "")
+		jobs.WaitAndClose()
+		assert.False(t, d.Schedule(cid.MustParse(rawCID)))
+	})
+}
+
+func TestRequestDeduplicator_Flush(t *testing.T) {
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+	d := NewRequestDeduplicator(&graphTest, 10, time.Hour)
+	for i := 0; i < 3; i++ {
+		d.Schedule(cid.MustParse(rawCID))
+	}
+	assert.Nil(t, d.Flush())
+	d.Schedule(cid.MustParse(rawCID))
+	assert.Nil(t, d.Close())
+
+	res, err := graphTest.Query("MATCH (b:Block {cid: '" + rawCID + "'}) RETURN b.requests")
+	assert.Nil(t, err)
+	assert.True(t, res.Next())
+	assert.Equal(t, 4, res.Record().GetByIndex(0))
+	assert.False(t, res.Next())
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// manifestFile is the name of the manifest of segments in an event log directory.
+const manifestFile = "manifest.json"
+
+// Segment describes a file of an event log and the time range of the events in it.
+type Segment struct {
+	File   string    `json:"file"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Events int       `json:"events"`
+}
+
+// Overlaps reports whether the segment contains events between from and to (zero values are unbounded).
+func (s Segment) Overlaps(from, to time.Time) bool {
+	return (to.IsZero() || !s.Start.After(to)) && (from.IsZero() || !s.End.Before(from))
+}
+
+// EventLogWriter writes events as JSON lines (one event per line) to segment files in a directory.
+// Segments are rotated once they exceed a size or age, and then compressed. A manifest lists all closed
+// segments with their time ranges, such that replays can select segments by time.
+type EventLogWriter struct {
+	dir         string
+	maxSize     int64
+	maxAge      time.Duration
+	compression string
+
+	mu       sync.Mutex
+	file     *os.File
+	buf      *bufio.Writer
+	size     int64
+	opened   time.Time
+	current  Segment
+	manifest []Segment
+}
+
+// NewEventLogWriter creates a writer for the event log in dir. Segments are rotated after maxSize bytes or
+// after maxAge and compressed with compression (gzip, zstd or none).
+func NewEventLogWriter(dir string, maxSize int64, maxAge time.Duration, compression string) (*EventLogWriter, error) {
+	switch compression {
+	case "gzip", "zstd", "none":
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	manifest, err := ReadManifest(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	w := &EventLogWriter{
+		dir:         dir,
+		maxSize:     maxSize,
+		maxAge:      maxAge,
+		compression: compression,
+		manifest:    manifest,
+	}
+	if err := w.recover(); err != nil {
+		return nil, fmt.Errorf("error recovering segments: %w", err)
+	}
+	return w, nil
+}
+
+// Write appends a batch of events to the log, one event per line.
+func (w *EventLogWriter) Write(events []Event) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file != nil && (w.size >= w.maxSize || time.Since(w.opened) >= w.maxAge) {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+
+	for _, ev := range events {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		n, err := w.buf.Write(append(data, '\n'))
+		if err != nil {
+			return err
+		}
+		w.size += int64(n)
+		if w.current.Events == 0 || ev.Timestamp.Before(w.current.Start) {
+			w.current.Start = ev.Timestamp
+		}
+		if ev.Timestamp.After(w.current.End) {
+			w.current.End = ev.Timestamp
+		}
+		w.current.Events++
+	}
+	return w.buf.Flush()
+}
+
+// Close closes and compresses the current segment.
+func (w *EventLogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	return w.rotate()
+}
+
+// open starts a new segment.
+func (w *EventLogWriter) open() error {
+	w.opened = time.Now()
+	name := w.opened.Format("20060102150405.000000000") + ".jsonl"
+	file, err := os.OpenFile(filepath.Join(w.dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w.file, w.buf, w.size = file, bufio.NewWriter(file), 0
+	w.current = Segment{File: name}
+	return nil
+}
+
+// rotate closes and compresses the current segment and adds it to the manifest.
+func (w *EventLogWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+	return w.finish(w.current)
+}
+
+// finish compresses a closed segment and adds it to the manifest. Empty segments are removed.
+func (w *EventLogWriter) finish(segment Segment) error {
+	if segment.Events == 0 {
+		return os.Remove(filepath.Join(w.dir, segment.File))
+	}
+	if w.compression != "none" && filepath.Ext(segment.File) == ".jsonl" {
+		name, err := compressFile(filepath.Join(w.dir, segment.File), w.compression)
+		if err != nil {
+			return err
+		}
+		segment.File = filepath.Base(name)
+	}
+	w.manifest = append(w.manifest, segment)
+	return writeManifest(w.dir, w.manifest)
+}
+
+// recover adds segments that are missing from the manifest, i.e. segments that were still open (or being
+// compressed) when a previous run was killed, to the manifest. A compressed copy of a segment whose plain file
+// still exists is incomplete and is replaced when the plain file is compressed.
+func (w *EventLogWriter) recover() error {
+	known := map[string]bool{}
+	for _, segment := range w.manifest {
+		known[segment.File] = true
+	}
+	paths, err := filepath.Glob(filepath.Join(w.dir, "*.jsonl*"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if known[name] {
+			continue
+		}
+		if plain := strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".zst"); plain != name {
+			if _, err := os.Stat(filepath.Join(w.dir, plain)); err == nil {
+				if err := os.Remove(path); err != nil {
+					return err
+				}
+				continue
+			}
+		} else if filepath.Ext(name) != ".jsonl" {
+			continue
+		}
+		segment, err := scanSegment(path)
+		if err != nil {
+			return err
+		}
+		if err := w.finish(segment); err != nil {
+			return err
+		}
+		if segment.Events > 0 {
+			known[w.manifest[len(w.manifest)-1].File] = true
+		}
+	}
+	return nil
+}
+
+// scanSegment determines the time range and number of events of a segment file. Lines that cannot be decoded,
+// such as a line that was cut off when the writer was killed, are not counted.
+func scanSegment(path string) (Segment, error) {
+	segment := Segment{File: filepath.Base(path)}
+	err := (&FileSource{}).readFile(path, func(r io.Reader) error {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 64<<20)
+		for scanner.Scan() {
+			var ev Event
+			if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+				continue
+			}
+			if segment.Events == 0 || ev.Timestamp.Before(segment.Start) {
+				segment.Start = ev.Timestamp
+			}
+			if ev.Timestamp.After(segment.End) {
+				segment.End = ev.Timestamp
+			}
+			segment.Events++
+		}
+		return scanner.Err()
+	})
+	return segment, err
+}
+
+// compressFile replaces the file at path with a compressed copy and returns the path of the copy.
+func compressFile(path string, compression string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	var dstPath string
+	switch compression {
+	case "gzip":
+		dstPath = path + ".gz"
+	case "zstd":
+		dstPath = path + ".zst"
+	}
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	var zw io.WriteCloser
+	if compression == "gzip" {
+		zw = gzip.NewWriter(dst)
+	} else if zw, err = zstd.NewWriter(dst); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(zw, src); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	if err := dst.Close(); err != nil {
+		return "", err
+	}
+	return dstPath, os.Remove(path)
+}
+
+// ReadManifest reads the manifest of segments in an event log directory.
+func ReadManifest(dir string) ([]Segment, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	var manifest []Segment
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// writeManifest atomically replaces the manifest in dir.
+func writeManifest(dir string, manifest []Segment) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, manifestFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, manifestFile))
+}
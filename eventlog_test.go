@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testEvents(t *testing.T) []Event {
+	batches := collectBatches(t, NewReaderSource("test", strings.NewReader(testEventLog)))
+	return append(batches[0], batches[1]...)
+}
+
+func TestEventLogWriter_Rotate(t *testing.T) {
+	for _, compression := range []string{"gzip", "zstd", "none"} {
+		t.Run(compression, func(t *testing.T) {
+			dir := t.TempDir()
+			events := testEvents(t)
+			w, err := NewEventLogWriter(dir, 1, time.Hour, compression)
+			assert.Nil(t, err)
+
+			// every write exceeds the maximum size, so each event ends up in its own segment
+			assert.Nil(t, w.Write(events[:1]))
+			assert.Nil(t, w.Write(events[1:]))
+			assert.Nil(t, w.Close())
+
+			manifest, err := ReadManifest(dir)
+			assert.Nil(t, err)
+			assert.Len(t, manifest, 2)
+			for i, segment := range manifest {
+				assert.Equal(t, 1, segment.Events)
+				assert.True(t, events[i].Timestamp.Equal(segment.Start))
+				assert.True(t, events[i].Timestamp.Equal(segment.End))
+				_, err := os.Stat(filepath.Join(dir, segment.File))
+				assert.Nil(t, err)
+			}
+
+			batches := collectBatches(t, &FileSource{Paths: []string{dir}})
+			assert.Len(t, batches, 2)
+			assert.Equal(t, "12D3KooWA", batches[0][0].Peer)
+			assert.Equal(t, "12D3KooWB", batches[1][0].Peer)
+		})
+	}
+}
+
+func TestEventLogWriter_Recover(t *testing.T) {
+	dir := t.TempDir()
+	events := testEvents(t)
+
+	// the first writer is killed without being closed, while a second segment was being compressed
+	killed, err := NewEventLogWriter(dir, 1<<20, time.Hour, "gzip")
+	assert.Nil(t, err)
+	assert.Nil(t, killed.Write(events))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, killed.current.File+".gz"), []byte("partial"), 0644))
+
+	w, err := NewEventLogWriter(dir, 1<<20, time.Hour, "gzip")
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+
+	manifest, err := ReadManifest(dir)
+	assert.Nil(t, err)
+	assert.Len(t, manifest, 1)
+	assert.Equal(t, killed.current.File+".gz", manifest[0].File)
+	assert.Equal(t, len(events), manifest[0].Events)
+	assert.True(t, events[0].Timestamp.Equal(manifest[0].Start))
+
+	batches := collectBatches(t, &FileSource{Paths: []string{dir}})
+	assert.Len(t, batches, len(events))
+}
+
+func TestEventLogWriter_InvalidCompression(t *testing.T) {
+	_, err := NewEventLogWriter(t.TempDir(), 1, time.Hour, "lz4")
+	assert.Error(t, err)
+}
+
+func TestFileSource_StreamTimeRange(t *testing.T) {
+	dir := t.TempDir()
+	events := testEvents(t)
+	w, err := NewEventLogWriter(dir, 1, time.Hour, "gzip")
+	assert.Nil(t, err)
+	assert.Nil(t, w.Write(events[:1]))
+	assert.Nil(t, w.Write(events[1:]))
+	assert.Nil(t, w.Close())
+
+	second := events[1].Timestamp
+	batches := collectBatches(t, &FileSource{Paths: []string{dir}, From: second})
+	assert.Len(t, batches, 1)
+	assert.Equal(t, "12D3KooWB", batches[0][0].Peer)
+
+	batches = collectBatches(t, &FileSource{Paths: []string{dir}, To: second.Add(-time.Millisecond)})
+	assert.Len(t, batches, 1)
+	assert.Equal(t, "12D3KooWA", batches[0][0].Peer)
+}
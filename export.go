@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+)
+
+// errUnsupportedType is returned for blocks that are neither files nor directories, symlinks or metadata, such as
+// dag-cbor nodes or DAG-PB nodes without a UnixFS payload.
+var errUnsupportedType = errors.New("unsupported root type")
+
+// MissingBlock is a block that is needed to export content but has not been replicated.
+type MissingBlock struct {
+	Cid cid.Cid
+	// Path is the exported path that the block belongs to.
+	Path string
+}
+
+// Exporter rebuilds files and directory trees from the replica, i.e. from the ordered :has edges in the graph
+// and the block data in the data folder.
+type Exporter struct {
+	graph   GraphQuerier
+	dataDir string
+	// Missing are the blocks that were missing during the export.
+	Missing []MissingBlock
+}
+
+// NewExporter creates an Exporter for the replica in graph and dataDir.
+func NewExporter(graph GraphQuerier, dataDir string) *Exporter {
+	return &Exporter{graph: graph, dataDir: dataDir}
+}
+
+// exportBlock is a block of the replica along with its outgoing links.
+type exportBlock struct {
+	typ    string
+	target string
+	links  []exportLink
+}
+
+// exportLink is a :has edge of the replica.
+type exportLink struct {
+	cid  cid.Cid
+	name string
+}
+
+// Export writes the content of root to dest. Content of missing blocks is skipped and the blocks are recorded
+// in Missing, so an incomplete replica yields files with gaps rather than an error. Existing files are never
+// overwritten and symlinks are never followed, so the content cannot be written outside dest.
+func (e *Exporter) Export(root cid.Cid, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+	return e.export(root, dest)
+}
+
+// export writes the content of a block to dest, whose parent directory exists.
+func (e *Exporter) export(root cid.Cid, dest string) error {
+	block, err := e.block(root)
+	if err != nil {
+		return err
+	}
+	if block == nil {
+		e.Missing = append(e.Missing, MissingBlock{root, dest})
+		return nil
+	}
+
+	switch block.typ {
+	case "Directory":
+		if err := mkdir(dest); err != nil {
+			return err
+		}
+		return e.exportEntries(block, dest)
+	case "HAMTShard":
+		if err := mkdir(dest); err != nil {
+			return err
+		}
+		return e.exportShard(block, dest, NewSet[string]())
+	case "Symlink":
+		return os.Symlink(block.target, dest)
+	case "Metadata":
+		// metadata wraps the actual content in its only link
+		if len(block.links) == 0 {
+			return nil
+		}
+		return e.export(block.links[0].cid, dest)
+	default:
+		if !isFile(block) {
+			typ := block.typ
+			if typ == "" {
+				typ = multicodec.Code(root.Type()).String()
+			}
+			return fmt.Errorf("%w %s of CID %s", errUnsupportedType, typ, root)
+		}
+		file, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0666)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err := e.writeFile(file, root, block, dest); err != nil {
+			return err
+		}
+		return file.Close()
+	}
+}
+
+// mkdir creates the directory path. An existing directory is reused, but not a symlink to one.
+func mkdir(path string) error {
+	err := os.Mkdir(path, os.ModePerm)
+	if !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s exists and is not a directory", path)
+	}
+	return nil
+}
+
+// exportEntries exports the entries of a directory into dest.
+func (e *Exporter) exportEntries(block *exportBlock, dest string) error {
+	names := NewSet[string]()
+	for _, link := range block.links {
+		if err := e.exportEntry(link.cid, link.name, dest, names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportShard exports the entries of a HAMT shard and its nested shards into dest. names are the entries of
+// the directory that were exported already.
+func (e *Exporter) exportShard(block *exportBlock, dest string, names *Set[string]) error {
+	for _, link := range block.links {
+		if link.name != "" {
+			if err := e.exportEntry(link.cid, link.name, dest, names); err != nil {
+				return err
+			}
+			continue
+		}
+		shard, err := e.block(link.cid)
+		if err != nil {
+			return err
+		}
+		if shard == nil {
+			e.Missing = append(e.Missing, MissingBlock{link.cid, dest})
+			continue
+		}
+		if err := e.exportShard(shard, dest, names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportEntry exports a directory entry, refusing names that would escape the directory and names that occur
+// more than once in it. names are the entries of the directory that were exported already.
+func (e *Exporter) exportEntry(_cid cid.Cid, name string, dir string, names *Set[string]) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid entry name %q in %s", name, dir)
+	}
+	if names.Has(name) {
+		return fmt.Errorf("duplicate entry name %q in %s", name, dir)
+	}
+	names.Add(name)
+	return e.export(_cid, filepath.Join(dir, name))
+}
+
+// writeFile writes the data of a file block to w: the data of a leaf, or the data of its links in order.
+func (e *Exporter) writeFile(w io.Writer, _cid cid.Cid, block *exportBlock, path string) error {
+	if len(block.links) == 0 {
+		data, err := os.Open(filepath.Join(e.dataDir, _cid.String()))
+		if errors.Is(err, os.ErrNotExist) {
+			// replicated UnixFS leaves without a data file carry no data, whereas raw blocks always have one
+			if _cid.Type() == cid.Raw {
+				e.Missing = append(e.Missing, MissingBlock{_cid, path})
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer data.Close()
+		_, err = io.Copy(w, data)
+		return err
+	}
+
+	for _, link := range block.links {
+		child, err := e.block(link.cid)
+		if err != nil {
+			return err
+		}
+		if child == nil {
+			e.Missing = append(e.Missing, MissingBlock{link.cid, path})
+			continue
+		}
+		if err := e.writeFile(w, link.cid, child, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// block queries a block and its links in order. It returns nil if the block has not been replicated.
+func (e *Exporter) block(_cid cid.Cid) (*exportBlock, error) {
+	qr, err := e.graph.Query(fmt.Sprintf(
+		"MATCH (b:Block {cid: '%s'}) WHERE b.state IN ['%s', '%s'] RETURN b.type, b.target",
+		_cid.String(), StateExpanded, StateComplete,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if !qr.Next() {
+		return nil, nil
+	}
+	block := &exportBlock{}
+	block.typ, _ = qr.Record().GetByIndex(0).(string)
+	block.target, _ = qr.Record().GetByIndex(1).(string)
+
+	qr, err = e.graph.Query(fmt.Sprintf(
+		"MATCH (:Block {cid: '%s'})-[e:has]->(c:Block) RETURN c.cid, e.name ORDER BY e.index",
+		_cid.String(),
+	))
+	if err != nil {
+		return nil, err
+	}
+	for qr.Next() {
+		c, err := cid.Parse(qr.Record().GetByIndex(0))
+		if err != nil {
+			return nil, err
+		}
+		link := exportLink{cid: c}
+		link.name, _ = qr.Record().GetByIndex(1).(string)
+		block.links = append(block.links, link)
+	}
+	return block, nil
+}
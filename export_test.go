@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/korovkin/limiter"
+	rg "github.com/redislabs/redisgraph-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExporter_Export(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+
+	fetcher := NewIPFSFetcher(context.Background(), NewMockIPFSNode(), graphPoolTest, ipfsTestDataPath, FetchLimits{Workers: 2, Network: 2})
+	jobs = limiter.NewConcurrencyLimiter(1)
+	fetcher.Download(cid.MustParse(directoryCID), "")
+	fetcher.Download(cid.MustParse(cborCID), "")
+	jobs.WaitAndClose()
+
+	t.Run("complete directory", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "dir")
+		exporter := NewExporter(&graphTest, ipfsTestDataPath)
+		assert.Nil(t, exporter.Export(cid.MustParse(directoryCID), dest))
+		assert.Empty(t, exporter.Missing)
+
+		data, err := os.ReadFile(filepath.Join(dest, "file.bin"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte{0x00, 0xFF, 0x00, 0xFF, 0x00, 0xFF, 0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, data)
+		data, err = os.ReadFile(filepath.Join(dest, "other.bin"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte{0xFF, 0x00, 0xFF, 0x00}, data)
+	})
+
+	t.Run("missing block", func(t *testing.T) {
+		assert.Nil(t, os.Remove(filepath.Join(ipfsTestDataPath, otherRawCID)))
+
+		dest := filepath.Join(t.TempDir(), "file.bin")
+		exporter := NewExporter(&graphTest, ipfsTestDataPath)
+		assert.Nil(t, exporter.Export(cid.MustParse(fileCID), dest))
+		assert.Equal(t, []MissingBlock{{cid.MustParse(otherRawCID), dest}}, exporter.Missing)
+
+		data, err := os.ReadFile(dest)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte{0x00, 0xFF, 0x00, 0xFF, 0x00, 0xFF, 0x00, 0xFF}, data)
+	})
+
+	t.Run("unsupported type", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "node")
+		err := NewExporter(&graphTest, ipfsTestDataPath).Export(cid.MustParse(cborCID), dest)
+		assert.ErrorIs(t, err, errUnsupportedType)
+		_, err = os.Lstat(dest)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestExporter_InvalidNames(t *testing.T) {
+	exporter := NewExporter(&graphTest, ipfsTestDataPath)
+	for _, name := range []string{"", ".", "..", "../x", "a/b", `a\b`} {
+		assert.Error(t, exporter.exportEntry(cid.MustParse(rawCID), name, t.TempDir(), NewSet[string]()), name)
+	}
+}
+
+func TestExporter_Escape(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+	assert.Nil(t, os.WriteFile(filepath.Join(ipfsTestDataPath, rawCID), []byte{0x00, 0xFF, 0x00, 0xFF}, 0644))
+
+	outside := t.TempDir()
+	// a directory whose entry "link" is both a symlink out of the directory and a directory with a file
+	_, err := graphTest.Query(fmt.Sprintf(
+		"CREATE (d:Block {cid: '%s', type: 'Directory', state: '%s'}), "+
+			"(s:Block {cid: '%s', type: 'Symlink', target: %s, state: '%s'}), "+
+			"(e:Block {cid: '%s', type: 'Directory', state: '%s'}), "+
+			"(r:Block {cid: '%s', type: 'Raw', state: '%s'}), "+
+			"(d)-[:has {name: 'link', index: 0}]->(s), (d)-[:has {name: 'link', index: 1}]->(e), "+
+			"(e)-[:has {name: 'x', index: 0}]->(r)",
+		directoryCID, StateComplete, cborCID, rg.ToString(outside), StateComplete,
+		gitCID, StateComplete, rawCID, StateComplete,
+	))
+	assert.Nil(t, err)
+
+	t.Run("duplicate entry", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "dir")
+		assert.Error(t, NewExporter(&graphTest, ipfsTestDataPath).Export(cid.MustParse(directoryCID), dest))
+		_, err := os.Lstat(filepath.Join(outside, "x"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("existing symlink", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "x")
+		assert.Nil(t, os.Symlink(filepath.Join(outside, "x"), dest))
+		assert.Error(t, NewExporter(&graphTest, ipfsTestDataPath).Export(cid.MustParse(rawCID), dest))
+		_, err := os.Lstat(filepath.Join(outside, "x"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("symlinked directory", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "link")
+		assert.Nil(t, os.Symlink(outside, dest))
+		assert.Error(t, NewExporter(&graphTest, ipfsTestDataPath).Export(cid.MustParse(gitCID), dest))
+		_, err := os.Lstat(filepath.Join(outside, "x"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
@@ -5,151 +5,414 @@ import (
 	"errors"
 	"fmt"
 	"github.com/ipfs/go-cid"
-	rg "github.com/redislabs/redisgraph-go"
+	format "github.com/ipfs/go-ipld-format"
+	ft "github.com/ipfs/go-unixfs"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 )
 
+// FetchLimits bounds the concurrency of a traversal. Graph writes are bounded by the connections of the
+// GraphQuerier (see GraphPool) and disk writes by the global jobs limiter.
+type FetchLimits struct {
+	// Workers is the number of blocks of a root that are expanded concurrently.
+	Workers int
+	// Network is the number of concurrent block retrievals from IPFS (shared by all traversals).
+	Network int
+	// Budget limits the traversal of each root.
+	Budget Budget
+}
+
 type IPFSFetcher struct {
 	ctx          context.Context
 	node         IPFSNode
-	graph        *rg.Graph
+	graph        GraphQuerier
 	DownloadPath string
+	limits       FetchLimits
+	// network is a semaphore that bounds concurrent block retrievals.
+	network chan struct{}
+	// Retries queues blocks whose retrieval failed for another attempt (nil gives up right away).
+	Retries *RetryQueue
+	// Dedup forgets the roots of traversals that failed or were truncated, so that further requests for them
+	// are passed on to the fetcher (nil if requests are not deduplicated).
+	Dedup *RequestDeduplicator
+
+	mu sync.Mutex
+	// visiting are the blocks that are currently being visited by a worker of any traversal.
+	visiting *Set[cid.Cid]
 }
 
-func NewIPFSFetcher(ctx context.Context, node IPFSNode, graph *rg.Graph, downloadPath string) *IPFSFetcher {
+func NewIPFSFetcher(ctx context.Context, node IPFSNode, graph GraphQuerier, downloadPath string, limits FetchLimits) *IPFSFetcher {
 	if err := os.Mkdir(downloadPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
 		log.Fatalf("error creating data folder: %v", err)
 	}
+	if limits.Workers < 1 {
+		limits.Workers = 1
+	}
+	if limits.Network < 1 {
+		limits.Network = 1
+	}
 	return &IPFSFetcher{
 		ctx:          ctx,
 		node:         node,
 		graph:        graph,
 		DownloadPath: downloadPath,
+		limits:       limits,
+		network:      make(chan struct{}, limits.Network),
+		visiting:     NewSet[cid.Cid](),
 	}
 }
 
-// Download will download the contents of the CID. This initiates a recursive process that creates the according
-// nodes and edges to the db graph and eventually creates the raw data as blobs on the disk.
-func (f *IPFSFetcher) Download(_cid cid.Cid, index int, parentNode *rg.Node) {
-	log.Println("Download " + _cid.String())
+// Download will download the contents of the CID. The DAG below it is traversed breadth-first by a pool of
+// workers that create the according nodes and edges in the db graph and eventually write the raw data as blobs
+// to the disk. Download returns once the traversal is complete; disk writes may still be pending in jobs.
+// Nodes and edges created in the process are tagged with the monitor that observed the request, if known.
+func (f *IPFSFetcher) Download(root cid.Cid, monitor string) {
+	f.traverse(traversalRoot{root, monitor, true})
+}
 
-	// create node
-	node := newNode(_cid)
-	qr, err := f.graph.Query("MERGE " + node.Encode())
-	if err != nil {
-		log.Fatalf("failed to merge node of CID %s: %v", _cid.String(), err)
+// traversalRoot is a block that a traversal starts at, along with the monitor that requested it.
+type traversalRoot struct {
+	cid     cid.Cid
+	monitor string
+	// requested is set for roots that were requested in a wantlist. Only those are classified as files, unlike
+	// inner blocks whose traversal is retried or resumed.
+	requested bool
+}
+
+// traverse downloads the DAGs below several roots with one pool of workers. Each root is traversed within its
+// own budget. traverse returns once all traversals are complete.
+func (f *IPFSFetcher) traverse(roots ...traversalRoot) {
+	visits := make([]visit, len(roots))
+	for i, r := range roots {
+		log.Println("Download " + r.cid.String())
+		t := newTraversal(r.monitor, f.limits.Budget)
+		t.root, t.requested = r.cid, r.requested
+		visits[i] = visit{cid: r.cid, traversal: t}
+	}
+	frontier := newFrontier(visits...)
+	var wg sync.WaitGroup
+	for i := 0; i < f.limits.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				v, ok := frontier.pop()
+				if !ok {
+					return
+				}
+				if v.traversal.admit(v) {
+					frontier.push(f.visit(v, v.traversal)...)
+				}
+				frontier.done()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, r := range roots {
+		if reason := visits[i].traversal.truncated(); reason != "" {
+			log.Printf("Traversal of CID %s truncated by its %s budget.", r.cid.String(), reason)
+			f.setTruncated(r.cid, reason)
+			f.forget(visits[i].traversal)
+		}
+		for _, file := range visits[i].traversal.files.Values() {
+			if f.unclassified(file) {
+				f.classifyPartial(file)
+			}
+		}
 	}
-	if qr.NodesCreated() > 0 {
-		log.Println("Node added: " + _cid.String())
+}
+
+// visit continues the traversal at a block according to its state and returns the blocks to visit next.
+// A block is only handled by one worker at a time; if another traversal holds it, that traversal finishes it.
+func (f *IPFSFetcher) visit(v visit, t *traversal) []visit {
+	if !f.claim(v.cid) {
+		return nil
 	}
+	defer f.release(v.cid)
 
-	// create edge to its parent
-	if parentNode != nil {
-		if _, err := f.graph.Query(fmt.Sprintf(
-			"MATCH (a:Block{cid:'%s'}), (b:Block{cid:'%s'}) MERGE (a)-[:has{index:%d}]->(b)",
-			parentNode.GetProperty("cid"),
-			node.GetProperty("cid"),
-			index,
-		)); err != nil {
-			log.Fatal(err)
+	state := f.mergeBlock(v.cid, t.monitor)
+	if v.depth == 0 && t.requested {
+		// the root exists in the graph now and is marked before it can complete
+		f.addFiles(t, v.cid)
+	}
+	var children []cid.Cid
+	switch state {
+	case StatePending, "":
+		children = f.expand(v.cid, t)
+	case StateFailed:
+		// the block failed in an earlier traversal and is retrieved again, unless it failed in this one already
+		if t.hasFailed(v.cid) {
+			return nil
 		}
-		log.Println("Edge added: " + parentNode.Alias + " has " + _cid.String())
+		f.setState(v.cid, StatePending)
+		children = f.expand(v.cid, t)
+	case StateExpanded:
+		// the block was expanded by an interrupted traversal, continue with its incomplete children
+		var entries []cid.Cid
+		children, entries = f.children(v.cid)
+		f.addFiles(t, entries...)
+		f.completeIfDone(v.cid)
+	default:
+		// blocks that are complete already were classified when they completed
+		return nil
+	}
+
+	next := make([]visit, len(children))
+	for i, child := range children {
+		next[i] = visit{cid: child, depth: v.depth + 1, traversal: t}
 	}
+	return next
+}
 
-	// if node already existed, we are done here
-	if qr.NodesCreated() == 0 {
-		return
+// claim reserves a block for the calling worker. It reports false if the block is already being visited.
+func (f *IPFSFetcher) claim(_cid cid.Cid) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.visiting.Has(_cid) {
+		return false
 	}
+	f.visiting.Add(_cid)
+	return true
+}
+
+// release frees a block reserved with claim.
+func (f *IPFSFetcher) release(_cid cid.Cid) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.visiting.Delete(_cid)
+}
 
+// expand retrieves a pending block, schedules its data to be written to disk and adds its children to the graph.
+// It returns the children that are yet to be visited. Blocks beyond the block limit of the traversal stay pending.
+func (f *IPFSFetcher) expand(_cid cid.Cid, t *traversal) []cid.Cid {
 	/**
 	In CIDv0, everything is a DAG-PB and further decoding is necessary to interpret the data (else-block).
 	In CIDv1, raw contents (and raw contents only) are encoded as RAW.
+	Blocks of other codecs (e.g. DAG-CBOR) are decoded into the IPLD data model (see expandIPLD).
 	*/
 	if _cid.Type() == cid.Raw {
 		if _, err := f.graph.Query(fmt.Sprintf("MATCH (b:Block {cid: '%s'}) SET b.type = 'Raw'", _cid.String())); err != nil {
 			log.Fatalf("failed to update type for node with CID %s: %v", _cid.String(), err)
 		}
 
-		if _, err := jobs.Execute(func() {
-			f.DownloadRawObject(_cid)
-		}); err != nil {
-			log.Fatal(err)
+		if f.exists(_cid) {
+			f.complete(_cid)
+			return nil
 		}
-	} else {
-		// get dag links and possibly attached raw data
-		fsNode, links, err := f.node.GetDAG(_cid)
-		if err != nil && (errors.Is(err, context.DeadlineExceeded) || os.IsTimeout(err) || strings.Contains(err.Error(), "context deadline exceeded")) {
-			log.Printf("Timeout for CID %s. Skip!", _cid.String())
-		} else if err != nil {
-			log.Printf("GetDAG for cid %s failed with error: %v\n", _cid.String(), err)
+		if !t.reserve() {
+			return nil
+		}
+		file, err := f.getFile(_cid)
+		if err != nil {
+			f.fail(t, _cid, err)
+			return nil
 		}
+		t.retrieved(len(file))
+		f.save(t, _cid, file)
+		return nil
+	}
+	if _cid.Type() != cid.DagProtobuf {
+		return f.expandIPLD(_cid, t)
+	}
 
-		if fsNode != nil {
-			if _, err := f.graph.Query(fmt.Sprintf(
-				"MATCH (b:Block {cid: '%s'}) SET b.type = '%s'",
-				_cid.String(),
-				fsNode.Type().String(),
-			)); err != nil {
-				log.Fatalf("failed to update type for node with cid %s: %v", _cid.String(), err)
-			}
+	// get the encoded block, verify it and decode its links and possibly attached raw data
+	if !t.reserve() {
+		return nil
+	}
+	data, err := f.getBlock(_cid)
+	if err != nil {
+		f.fail(t, _cid, err)
+		return nil
+	}
+	t.retrieved(len(data))
+	if err := checkBlock(_cid, data); err != nil {
+		f.rejectBlock(t, _cid, err)
+		return nil
+	}
+	fsNode, links, err := decodeDAG(data)
+	if err != nil {
+		f.fail(t, _cid, err)
+		return nil
+	}
+
+	if fsNode == nil {
+		log.Printf("CID %s is no UnixFS node, only its links are followed.", _cid.String())
+	} else if _, err := f.graph.Query(fmt.Sprintf(
+		"MATCH (b:Block {cid: '%s'}) SET %s",
+		_cid.String(),
+		setProperties("b", unixfsProperties(fsNode, links)),
+	)); err != nil {
+		log.Fatalf("failed to update type for node with cid %s: %v", _cid.String(), err)
+	}
+
+	// Policy: blocks with links are expanded, file data of leaves is written to disk.
+	if len(links) > 0 {
+		return f.expandLinks(_cid, fsNode, links, t)
+	} else if hasData(fsNode) {
+		f.save(t, _cid, fsNode.Data())
+	} else {
+		f.complete(_cid)
+	}
+	return nil
+}
+
+// expandIPLD retrieves a pending block of a codec other than DAG-PB and raw and adds the children it links to
+// the graph. The kind of the decoded node is stored on its block. Every block is written to disk as it is encoded,
+// including blocks of codecs that cannot be decoded, which are marked with unknown_codec.
+func (f *IPFSFetcher) expandIPLD(_cid cid.Cid, t *traversal) []cid.Cid {
+	if !t.reserve() {
+		return nil
+	}
+	data, err := f.getBlock(_cid)
+	if err != nil {
+		f.fail(t, _cid, err)
+		return nil
+	}
+	t.retrieved(len(data))
+	if err := checkBlock(_cid, data); err != nil {
+		f.rejectBlock(t, _cid, err)
+		return nil
+	}
+
+	node, err := decodeIPLD(_cid, data)
+	if errors.Is(err, errUnknownCodec) {
+		log.Printf("Cannot decode CID %s: %v", _cid.String(), err)
+		if _, err := f.graph.Query(fmt.Sprintf("MATCH (b:Block {cid: '%s'}) SET b.unknown_codec = true", _cid.String())); err != nil {
+			log.Fatalf("failed to update codec of CID %s: %v", _cid.String(), err)
 		}
+		f.save(t, _cid, data)
+		return nil
+	} else if err != nil {
+		f.fail(t, _cid, err)
+		return nil
+	}
+	links, err := ipldLinks(node)
+	if err != nil {
+		f.fail(t, _cid, err)
+		return nil
+	}
+	if _, err := f.graph.Query(fmt.Sprintf(
+		"MATCH (b:Block {cid: '%s'}) SET b.kind = '%s'", _cid.String(), node.Kind().String(),
+	)); err != nil {
+		log.Fatalf("failed to update kind of CID %s: %v", _cid.String(), err)
+	}
 
-		// Policy: If it has links, treat it as a dag; otherwise, treat it as a raw. Lol.
-		if len(links) > 0 {
-			// a set is sufficient and will reduce redundant and expensive network requests
-			linkedCids := NewSet[cid.Cid]()
-			for _, link := range links {
-				linkedCids.Add(link.Cid)
-			}
-			for i, ref := range linkedCids.Values() {
-				// recursively call Download on all refs
-				f.Download(ref, i, node)
-			}
-		} else if fsNode != nil && len(fsNode.Data()) > 0 {
-			if _, err := jobs.Execute(func() {
-				f.SaveRawObject(_cid, fsNode.Data())
-			}); err != nil {
-				log.Fatal(err)
-			}
+	if len(links) == 0 {
+		f.save(t, _cid, data)
+		return nil
+	}
+	// blocks with links are written before they are expanded, since their children may complete them right away
+	if err := f.write(_cid, data); err != nil {
+		f.rejectBlock(t, _cid, err)
+		return nil
+	}
+	return f.expandLinks(_cid, nil, links, t)
+}
+
+// expandLinks adds the children of a block to the graph and marks it as expanded. It returns the distinct children.
+func (f *IPFSFetcher) expandLinks(_cid cid.Cid, fsNode *ft.FSNode, links []*format.Link, t *traversal) []cid.Cid {
+	f.mergeChildren(_cid, fsNode, links, t.monitor)
+	if fsNode != nil {
+		f.addFiles(t, directoryEntries(fsNode, links)...)
+	}
+	// each distinct child is visited once, which avoids redundant and expensive network requests
+	linkedCids := NewSet[cid.Cid]()
+	children := make([]cid.Cid, 0, len(links))
+	for _, link := range links {
+		if !linkedCids.Has(link.Cid) {
+			linkedCids.Add(link.Cid)
+			children = append(children, link.Cid)
 		}
 	}
+	f.setState(_cid, StateExpanded)
+	// children may be complete already
+	f.completeIfDone(_cid)
+	return children
 }
 
-// DownloadRawObject downloads the CID's raw content to a binary file on the disk.
-func (f *IPFSFetcher) DownloadRawObject(_cid cid.Cid) {
-	// check if file already exists
-	if _, err := os.Stat(f.DownloadPath + "/" + _cid.String()); err == nil {
-		return
+// save schedules the data of a block to be written to disk, after which the block is complete.
+func (f *IPFSFetcher) save(t *traversal, _cid cid.Cid, data []byte) {
+	if _, err := jobs.Execute(func() {
+		if err := f.SaveRawObject(_cid, data); err != nil {
+			f.rejectBlock(t, _cid, err)
+			return
+		}
+		f.complete(_cid)
+	}); err != nil {
+		log.Fatal(err)
 	}
+}
 
-	// get file contents as binary
-	file, err := f.node.GetFile(_cid)
-	if err != nil && (errors.Is(err, context.DeadlineExceeded) || os.IsTimeout(err) || strings.Contains(err.Error(), "context deadline exceeded")) {
-		log.Printf("Timeout for CID %s. Skip!", _cid.String())
-		return
-	} else if err != nil {
+// write writes the data of a block to disk within the disk write limit and waits for it to be written.
+func (f *IPFSFetcher) write(_cid cid.Cid, data []byte) error {
+	done := make(chan error, 1)
+	if _, err := jobs.Execute(func() {
+		done <- f.SaveRawObject(_cid, data)
+	}); err != nil {
 		log.Fatal(err)
 	}
+	return <-done
+}
 
-	if err := os.WriteFile(f.DownloadPath+"/"+_cid.String(), file, 0644); err != nil {
-		log.Fatal("failed to write cid contents to file: ", err)
+// getBlock retrieves the encoded data of a block from IPFS within the network limit.
+func (f *IPFSFetcher) getBlock(_cid cid.Cid) ([]byte, error) {
+	f.network <- struct{}{}
+	defer func() { <-f.network }()
+	return f.node.GetBlock(_cid)
+}
+
+// getFile retrieves a raw object from IPFS within the network limit.
+func (f *IPFSFetcher) getFile(_cid cid.Cid) ([]byte, error) {
+	f.network <- struct{}{}
+	defer func() { <-f.network }()
+	return f.node.GetFile(_cid)
+}
+
+// forget lets further requests for the root of a traversal that failed or was truncated pass the deduplication.
+func (f *IPFSFetcher) forget(t *traversal) {
+	if f.Dedup != nil {
+		f.Dedup.Forget(t.root)
 	}
+}
+
+// exists checks whether the CID's content has already been written to the disk.
+func (f *IPFSFetcher) exists(_cid cid.Cid) bool {
+	_, err := os.Stat(filepath.Join(f.DownloadPath, _cid.String()))
+	return err == nil
+}
 
-	log.Printf("New file downloaded (CID: %s, Size: %d).\n", _cid.String(), len(file))
+// isTimeout reports whether an IPFS retrieval failed because it took too long.
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || os.IsTimeout(err) || strings.Contains(err.Error(), "context deadline exceeded")
 }
 
-// SaveRawObject save the CID's raw content to a binary file on the disk.
-func (f *IPFSFetcher) SaveRawObject(_cid cid.Cid, raw []byte) {
+// SaveRawObject save the CID's raw content to a binary file on the disk. Blocks that are stored as they are
+// encoded are verified against their CID first; mismatching data is not written and errHashMismatch is returned.
+func (f *IPFSFetcher) SaveRawObject(_cid cid.Cid, raw []byte) error {
 	// check if file already exists
-	if _, err := os.Stat(f.DownloadPath + _cid.String()); err == nil {
-		return
+	if f.exists(_cid) {
+		return nil
+	}
+	if storedEncoded(_cid) {
+		if err := checkBlock(_cid, raw); err != nil {
+			return err
+		}
+	} else {
+		// the hash is written before the data, so that every stored DAG-PB leaf can be verified offline
+		hashPath := filepath.Join(f.DownloadPath, _cid.String()+dataHashSuffix)
+		if err := os.WriteFile(hashPath, []byte(dataHash(raw)), 0644); err != nil {
+			log.Fatal("failed to write hash of cid contents to file: ", err)
+		}
 	}
 
-	if err := os.WriteFile(f.DownloadPath+"/"+_cid.String(), raw, 0644); err != nil {
+	if err := os.WriteFile(filepath.Join(f.DownloadPath, _cid.String()), raw, 0644); err != nil {
 		log.Fatal("failed to write cid contents to file: ", err)
 	}
 
 	log.Printf("New file downloaded (CID: %s, Size: %d).\n", _cid.String(), len(raw))
+	return nil
 }
@@ -11,6 +11,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -19,6 +21,9 @@ const ipfsTestDataPath = ".test-data"
 var mockedFetcher *IPFSFetcher
 var graphTest rg.Graph
 
+// graphPoolTest gives the concurrent workers of fetchers under test separate connections to the test graph.
+var graphPoolTest *GraphPool
+
 func init() {
 	conn, err := redis.Dial("tcp", rgHost)
 	if err != nil {
@@ -26,20 +31,33 @@ func init() {
 	}
 	graphTest = rg.GraphNew("ipfs_test", conn)
 	graphTest.Delete()
+	var graphs []GraphQuerier
+	for i := 0; i < 4; i++ {
+		conn, err := redis.Dial("tcp", rgHost)
+		if err != nil {
+			log.Fatal(err)
+		}
+		g := rg.GraphNew("ipfs_test", conn)
+		graphs = append(graphs, &g)
+	}
+	graphPoolTest = NewGraphPool(graphs...)
 	mockedFetcher = NewIPFSFetcher(
 		context.Background(),
 		NewMockIPFSNode(),
-		&graphTest,
+		graphPoolTest,
 		ipfsTestDataPath,
+		FetchLimits{Workers: 2, Network: 2},
 	)
 }
 
-func TestIPFSFetcher_DownloadRawObject(t *testing.T) {
+func TestIPFSFetcher_DownloadRawBlock(t *testing.T) {
 	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
 		panic(err)
 	}
 	defer os.RemoveAll(ipfsTestDataPath)
-	mockedFetcher.DownloadRawObject(cid.MustParse(rawCID))
+	jobs = limiter.NewConcurrencyLimiter(1)
+	mockedFetcher.Download(cid.MustParse(rawCID), "")
+	jobs.WaitAndClose()
 	defer graphTest.Query("MATCH (b:Block) DELETE b")
 	const filePath = ipfsTestDataPath + "/" + rawCID
 
@@ -53,7 +71,9 @@ func TestIPFSFetcher_DownloadRawObject(t *testing.T) {
 		assert.Equal(t, []byte{0x00, 0xFF, 0x00, 0xFF}, blob)
 	})
 	t.Run("can safely re-download this file", func(t *testing.T) {
-		mockedFetcher.DownloadRawObject(cid.MustParse(rawCID))
+		jobs = limiter.NewConcurrencyLimiter(1)
+		mockedFetcher.Download(cid.MustParse(rawCID), "")
+		jobs.WaitAndClose()
 		blob, err := os.ReadFile(filePath)
 		assert.Nil(t, err)
 		assert.Equal(t, []byte{0x00, 0xFF, 0x00, 0xFF}, blob)
@@ -70,7 +90,7 @@ func TestIPFSFetcher_Download(t *testing.T) {
 	t.Run("raw object with no parent", func(t *testing.T) {
 		const filePath = ipfsTestDataPath + "/" + rawCID
 		jobs = limiter.NewConcurrencyLimiter(1)
-		mockedFetcher.Download(cid.MustParse(rawCID), 0, nil)
+		mockedFetcher.Download(cid.MustParse(rawCID), "")
 		defer os.Remove(filePath)
 		jobs.WaitAndClose()
 
@@ -93,7 +113,7 @@ func TestIPFSFetcher_Download(t *testing.T) {
 
 		t.Run("handle duplicate encounter", func(t *testing.T) {
 			jobs = limiter.NewConcurrencyLimiter(1)
-			mockedFetcher.Download(cid.MustParse(rawCID), 0, nil)
+			mockedFetcher.Download(cid.MustParse(rawCID), "")
 			jobs.WaitAndClose()
 
 			// check if node exists with no duplicate
@@ -115,7 +135,7 @@ func TestIPFSFetcher_Download(t *testing.T) {
 
 	t.Run("file with 3 raw objects", func(t *testing.T) {
 		jobs = limiter.NewConcurrencyLimiter(1)
-		mockedFetcher.Download(cid.MustParse(fileCID), 0, nil)
+		mockedFetcher.Download(cid.MustParse(fileCID), "")
 		jobs.WaitAndClose()
 
 		res, err := graphTest.Query(fmt.Sprintf("MATCH (f:Block { cid: '%s' }) RETURN f", fileCID))
@@ -130,7 +150,7 @@ func TestIPFSFetcher_Download(t *testing.T) {
 
 	t.Run("directory with file and raw object", func(t *testing.T) {
 		jobs = limiter.NewConcurrencyLimiter(1)
-		mockedFetcher.Download(cid.MustParse(directoryCID), 0, nil)
+		mockedFetcher.Download(cid.MustParse(directoryCID), "")
 		jobs.WaitAndClose()
 
 		t.Run("directory node exists uniquely", func(t *testing.T) {
@@ -189,3 +209,247 @@ func TestIPFSFetcher_Download(t *testing.T) {
 		})
 	})
 }
+
+func TestIPFSFetcher_State(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+
+	state := func(c string) interface{} {
+		res, err := graphTest.Query(fmt.Sprintf("MATCH (b:Block { cid: '%s' }) RETURN b.state", c))
+		assert.Nil(t, err)
+		assert.True(t, res.Next())
+		return res.Record().GetByIndex(0)
+	}
+
+	t.Run("completed traversal", func(t *testing.T) {
+		jobs = limiter.NewConcurrencyLimiter(1)
+		mockedFetcher.Download(cid.MustParse(directoryCID), "")
+		jobs.WaitAndClose()
+
+		for _, c := range []string{directoryCID, fileCID, rawCID, otherRawCID, yetAnotherRawCID} {
+			assert.Equal(t, StateComplete, state(c), c)
+		}
+	})
+
+	t.Run("failed retrieval", func(t *testing.T) {
+		const unknownCID = "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"
+		jobs = limiter.NewConcurrencyLimiter(1)
+		mockedFetcher.Download(cid.MustParse(unknownCID), "")
+		jobs.WaitAndClose()
+
+		assert.Equal(t, StateFailed, state(unknownCID))
+		res, err := graphTest.Query(fmt.Sprintf(
+			"MATCH (b:Block { cid: '%s' }) RETURN b.attempts, b.last_error", unknownCID,
+		))
+		assert.Nil(t, err)
+		assert.True(t, res.Next())
+		assert.Equal(t, 1, res.Record().GetByIndex(0))
+		assert.Equal(t, "invalid cid", res.Record().GetByIndex(1))
+	})
+
+	t.Run("resume interrupted traversal", func(t *testing.T) {
+		graphTest.Query("MATCH (b:Block) DELETE b")
+		// the directory was expanded, but its children were never visited
+		_, err := graphTest.Query(fmt.Sprintf(
+			"CREATE (d:Block {cid: '%s', codec: 'dag-pb', state: '%s'}), "+
+				"(d)-[:has {index: 0}]->(:Block {cid: '%s', codec: 'dag-pb', state: '%s'}), "+
+				"(d)-[:has {index: 1}]->(:Block {cid: '%s', codec: 'raw', state: '%s'})",
+			directoryCID, StateExpanded, fileCID, StatePending, yetAnotherRawCID, StatePending,
+		))
+		assert.Nil(t, err)
+
+		jobs = limiter.NewConcurrencyLimiter(1)
+		mockedFetcher.Resume()
+		jobs.WaitAndClose()
+
+		for _, c := range []string{directoryCID, fileCID, rawCID, otherRawCID, yetAnotherRawCID} {
+			assert.Equal(t, StateComplete, state(c), c)
+		}
+	})
+
+	t.Run("child linked more than once", func(t *testing.T) {
+		graphTest.Query("MATCH (b:Block) DELETE b")
+		_, err := graphTest.Query(fmt.Sprintf(
+			"CREATE (d:Block {cid: '%s', codec: 'dag-pb', type: 'Directory', state: '%s'}), "+
+				"(f:Block {cid: '%s', codec: 'dag-pb', state: '%s'}), "+
+				"(d)-[:has {index: 0, name: ''}]->(f), (d)-[:has {index: 1, name: 'file'}]->(f)",
+			directoryCID, StateExpanded, fileCID, StatePending,
+		))
+		assert.Nil(t, err)
+
+		children, entries := mockedFetcher.children(cid.MustParse(directoryCID))
+		assert.Equal(t, []cid.Cid{cid.MustParse(fileCID)}, children)
+		assert.Equal(t, []cid.Cid{cid.MustParse(fileCID)}, entries)
+	})
+
+	t.Run("failed block is retrieved again when it is reached again", func(t *testing.T) {
+		graphTest.Query("MATCH (b:Block) DELETE b")
+		os.RemoveAll(ipfsTestDataPath)
+		os.Mkdir(ipfsTestDataPath, os.ModePerm)
+		// the fetcher has no retry queue, so the corrupt chunk is not retried on its own
+		fetcher := NewIPFSFetcher(context.Background(), &corruptIPFSNode{NewMockIPFSNode()}, graphPoolTest, ipfsTestDataPath,
+			FetchLimits{Workers: 2, Network: 2})
+		jobs = limiter.NewConcurrencyLimiter(1)
+		fetcher.Download(cid.MustParse(fileCID), "")
+		jobs.WaitAndClose()
+		assert.Equal(t, StateFailed, state(otherRawCID))
+
+		jobs = limiter.NewConcurrencyLimiter(1)
+		mockedFetcher.Download(cid.MustParse(fileCID), "")
+		jobs.WaitAndClose()
+		for _, c := range []string{fileCID, rawCID, otherRawCID} {
+			assert.Equal(t, StateComplete, state(c), c)
+		}
+	})
+}
+
+func TestIPFSFetcher_Budget(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+
+	fetcher := NewIPFSFetcher(context.Background(), NewMockIPFSNode(), graphPoolTest, ipfsTestDataPath, FetchLimits{
+		Workers: 2,
+		Network: 2,
+		Budget:  Budget{MaxDepth: 1},
+	})
+	jobs = limiter.NewConcurrencyLimiter(1)
+	fetcher.Download(cid.MustParse(directoryCID), "")
+	jobs.WaitAndClose()
+
+	res, err := graphTest.Query(fmt.Sprintf(
+		"MATCH (d:Block { cid: '%s' }), (r:Block { cid: '%s' }) RETURN d.truncated, d.truncated_by, d.state, r.state",
+		directoryCID, rawCID,
+	))
+	assert.Nil(t, err)
+	assert.True(t, res.Next())
+	assert.Equal(t, []interface{}{true, TruncatedByDepth, StateExpanded, StatePending}, res.Record().Values())
+
+	truncated := func() interface{} {
+		res, err := graphTest.Query(fmt.Sprintf("MATCH (d:Block { cid: '%s' }) RETURN d.truncated", directoryCID))
+		assert.Nil(t, err)
+		assert.True(t, res.Next())
+		return res.Record().GetByIndex(0)
+	}
+	t.Run("flag is kept while blocks below the root are incomplete", func(t *testing.T) {
+		fetcher := NewIPFSFetcher(context.Background(), &corruptIPFSNode{NewMockIPFSNode()}, graphPoolTest, ipfsTestDataPath,
+			FetchLimits{Workers: 2, Network: 2})
+		jobs = limiter.NewConcurrencyLimiter(1)
+		fetcher.Download(cid.MustParse(directoryCID), "")
+		jobs.WaitAndClose()
+		assert.Equal(t, true, truncated())
+	})
+	t.Run("flag is cleared once the root is complete", func(t *testing.T) {
+		fetcher := NewIPFSFetcher(context.Background(), NewMockIPFSNode(), graphPoolTest, ipfsTestDataPath,
+			FetchLimits{Workers: 2, Network: 2})
+		_, err := graphTest.Query(fmt.Sprintf("MATCH (b:Block { cid: '%s' }) SET b.state = '%s'", otherRawCID, StatePending))
+		assert.Nil(t, err)
+		// the leaf was rejected above, so it is fetched and written by a job after the traversal returns
+		_, err = os.Stat(filepath.Join(ipfsTestDataPath, otherRawCID))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		jobs = limiter.NewConcurrencyLimiter(1)
+		fetcher.Download(cid.MustParse(directoryCID), "")
+		jobs.WaitAndClose()
+		_, err = os.Stat(filepath.Join(ipfsTestDataPath, otherRawCID))
+		assert.Nil(t, err)
+		assert.Equal(t, false, truncated())
+	})
+}
+
+func TestIPFSFetcher_BudgetComplete(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+
+	// the entries of the directory were replicated before
+	jobs = limiter.NewConcurrencyLimiter(1)
+	mockedFetcher.Download(cid.MustParse(fileCID), "")
+	mockedFetcher.Download(cid.MustParse(yetAnotherRawCID), "")
+	jobs.WaitAndClose()
+
+	fetcher := NewIPFSFetcher(context.Background(), NewMockIPFSNode(), graphPoolTest, ipfsTestDataPath, FetchLimits{
+		Workers: 2,
+		Network: 2,
+		Budget:  Budget{MaxBlocks: 1},
+	})
+	jobs = limiter.NewConcurrencyLimiter(1)
+	fetcher.Download(cid.MustParse(directoryCID), "")
+	jobs.WaitAndClose()
+
+	// the visits of the entries exceed the budget, but the directory is complete without them
+	res, err := graphTest.Query(fmt.Sprintf(
+		"MATCH (d:Block { cid: '%s' }) RETURN d.state, d.truncated", directoryCID,
+	))
+	assert.Nil(t, err)
+	assert.True(t, res.Next())
+	assert.Equal(t, []interface{}{StateComplete, nil}, res.Record().Values())
+}
+
+// countingIPFSNode counts the retrievals of each CID.
+type countingIPFSNode struct {
+	IPFSNode
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (n *countingIPFSNode) GetFile(_cid cid.Cid) ([]byte, error) {
+	n.mu.Lock()
+	n.calls[_cid.String()]++
+	n.mu.Unlock()
+	return n.IPFSNode.GetFile(_cid)
+}
+
+func TestIPFSFetcher_Links(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+
+	node := &countingIPFSNode{IPFSNode: NewMockIPFSNode(), calls: map[string]int{}}
+	fetcher := NewIPFSFetcher(context.Background(), node, graphPoolTest, ipfsTestDataPath, FetchLimits{Workers: 2, Network: 2})
+	jobs = limiter.NewConcurrencyLimiter(1)
+	fetcher.Download(cid.MustParse(directoryCID), "")
+	jobs.WaitAndClose()
+
+	t.Run("edges preserve order and duplicate links", func(t *testing.T) {
+		res, err := graphTest.Query(fmt.Sprintf(
+			"MATCH (:Block { cid: '%s' })-[e:has]->(b:Block) RETURN e.index, b.cid, e.size ORDER BY e.index",
+			fileCID,
+		))
+		assert.Nil(t, err)
+		var links [][]interface{}
+		for res.Next() {
+			links = append(links, res.Record().Values())
+		}
+		assert.Equal(t, [][]interface{}{
+			{0, rawCID, 4},
+			{1, rawCID, 4},
+			{2, otherRawCID, 4},
+		}, links)
+	})
+
+	t.Run("edges carry link names", func(t *testing.T) {
+		res, err := graphTest.Query(fmt.Sprintf(
+			"MATCH (:Block { cid: '%s' })-[e:has]->(b:Block) RETURN e.name, e.size ORDER BY e.index",
+			directoryCID,
+		))
+		assert.Nil(t, err)
+		var links [][]interface{}
+		for res.Next() {
+			links = append(links, res.Record().Values())
+		}
+		assert.Equal(t, [][]interface{}{{"file.bin", 12}, {"other.bin", 4}}, links)
+	})
+
+	t.Run("each distinct child is fetched once", func(t *testing.T) {
+		assert.Equal(t, map[string]int{rawCID: 1, otherRawCID: 1, yetAnotherRawCID: 1}, node.calls)
+	})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	rg "github.com/redislabs/redisgraph-go"
+)
+
+// sniffLen is the number of leading bytes of a file that its type is detected from.
+const sniffLen = 512
+
+// magicNumbers are the signatures of formats that http.DetectContentType does not know.
+var magicNumbers = []struct {
+	offset int
+	magic  []byte
+	mime   string
+}{
+	{0, []byte("\x7FELF"), "application/x-executable"},
+	{0, []byte("BZh"), "application/x-bzip2"},
+	{0, []byte("\xFD7zXZ\x00"), "application/x-xz"},
+	{0, []byte("\x28\xB5\x2F\xFD"), "application/zstd"},
+	{0, []byte("7z\xBC\xAF\x27\x1C"), "application/x-7z-compressed"},
+	{0, []byte("fLaC"), "audio/flac"},
+	{4, []byte("ftypqt"), "video/quicktime"},
+	{4, []byte("ftypheic"), "image/heic"},
+	{4, []byte("ftypavif"), "image/avif"},
+	{257, []byte("ustar"), "application/x-tar"},
+}
+
+// categories map MIME types that are not categorised by their top-level type.
+var categories = map[string]string{
+	"application/pdf":                               "document",
+	"application/postscript":                        "document",
+	"application/zip":                               "archive",
+	"application/x-gzip":                            "archive",
+	"application/x-rar-compressed":                  "archive",
+	"application/x-bzip2":                           "archive",
+	"application/x-xz":                              "archive",
+	"application/zstd":                              "archive",
+	"application/x-7z-compressed":                   "archive",
+	"application/x-tar":                             "archive",
+	"application/wasm":                              "executable",
+	"application/x-executable":                      "executable",
+	"application/vnd.microsoft.portable-executable": "executable",
+	"application/ogg":                               "audio",
+	"application/json":                              "text",
+	"application/vnd.ms-fontobject":                 "font",
+}
+
+// detectContentType returns the MIME type (without parameters) and category of data from its leading bytes.
+// The category is one of image, video, audio, text, document, archive, executable, font or unknown.
+func detectContentType(data []byte) (mimeType, category string) {
+	for _, m := range magicNumbers {
+		if len(data) >= m.offset && bytes.HasPrefix(data[m.offset:], m.magic) {
+			mimeType = m.mime
+			break
+		}
+	}
+	if mimeType == "" && isPortableExecutable(data) {
+		mimeType = "application/vnd.microsoft.portable-executable"
+	}
+	if mimeType == "" {
+		mimeType, _, _ = strings.Cut(http.DetectContentType(data), ";")
+	}
+
+	if category, ok := categories[mimeType]; ok {
+		return mimeType, category
+	}
+	switch kind, _, _ := strings.Cut(mimeType, "/"); kind {
+	case "image", "video", "audio", "text", "font":
+		return mimeType, kind
+	default:
+		return mimeType, "unknown"
+	}
+}
+
+// isPortableExecutable reports whether data starts with an MZ header whose e_lfanew field (at 0x3C) points to
+// a PE signature. Plenty of other data starts with "MZ".
+func isPortableExecutable(data []byte) bool {
+	if len(data) < 0x40 || !bytes.HasPrefix(data, []byte("MZ")) {
+		return false
+	}
+	offset := int64(binary.LittleEndian.Uint32(data[0x3C:]))
+	return offset+4 <= int64(len(data)) && bytes.Equal(data[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+// errSniffed stops writing a file once its leading bytes are read.
+var errSniffed = errors.New("leading bytes read")
+
+// sniffBuffer collects the leading bytes of a file. It only implements io.Writer: the buffer is not embedded,
+// since io.Copy would bypass Write through its ReadFrom method and read the whole file.
+type sniffBuffer struct {
+	buf bytes.Buffer
+}
+
+// Write implements io.Writer and fails with errSniffed once sniffLen bytes are collected.
+func (b *sniffBuffer) Write(p []byte) (int, error) {
+	if n := sniffLen - b.buf.Len(); len(p) > n {
+		b.buf.Write(p[:n])
+		return n, errSniffed
+	}
+	return b.buf.Write(p)
+}
+
+// Bytes returns the collected bytes.
+func (b *sniffBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// Len returns the number of collected bytes.
+func (b *sniffBuffer) Len() int {
+	return b.buf.Len()
+}
+
+// addFiles records roots and directory entries reached by a traversal, such that they are classified. Files that
+// are not complete yet are marked with unclassified on their node, so that they are classified when they complete,
+// even if that happens after the traversal returned (e.g. in a disk write job).
+func (f *IPFSFetcher) addFiles(t *traversal, files ...cid.Cid) {
+	if len(files) == 0 {
+		return
+	}
+	t.mu.Lock()
+	t.files.Add(files...)
+	t.mu.Unlock()
+	entries := make([]string, len(files))
+	for i, file := range files {
+		entries[i] = rg.ToString(file.String())
+	}
+	if _, err := f.graph.Query(fmt.Sprintf(
+		"UNWIND [%s] AS c MATCH (b:Block {cid: c}) WHERE b.state IS NULL OR b.state <> '%s' SET b.unclassified = true",
+		strings.Join(entries, ", "), StateComplete,
+	)); err != nil {
+		log.Fatalf("failed to mark files to classify: %v", err)
+	}
+}
+
+// takeFile reports whether a completed block is a root or directory entry that is yet to be classified, and
+// clears its mark such that it is classified only once.
+func (f *IPFSFetcher) takeFile(_cid cid.Cid) bool {
+	qr, err := f.graph.Query(fmt.Sprintf(
+		"MATCH (b:Block {cid: '%s'}) WHERE b.unclassified = true SET b.unclassified = false", _cid.String(),
+	))
+	if err != nil {
+		log.Fatalf("failed to take file of CID %s: %v", _cid.String(), err)
+	}
+	return qr.PropertiesSet() > 0
+}
+
+// unclassified reports whether a root or directory entry has not been classified as a complete file.
+func (f *IPFSFetcher) unclassified(_cid cid.Cid) bool {
+	qr, err := f.graph.Query(fmt.Sprintf(
+		"MATCH (b:Block {cid: '%s'}) RETURN b.unclassified = true", _cid.String(),
+	))
+	if err != nil {
+		log.Fatalf("failed to query classification of CID %s: %v", _cid.String(), err)
+	}
+	if !qr.Next() {
+		return false
+	}
+	unclassified, _ := qr.Record().GetByIndex(0).(bool)
+	return unclassified
+}
+
+// isFile reports whether a block holds the data of a file, as opposed to a directory, symlink or IPLD node.
+func isFile(block *exportBlock) bool {
+	return block.typ == "File" || block.typ == "Raw"
+}
+
+// classify detects the type of a completely replicated file from its reassembled leading bytes.
+func (f *IPFSFetcher) classify(_cid cid.Cid) {
+	exporter := NewExporter(f.graph, f.DownloadPath)
+	block, err := exporter.block(_cid)
+	if err != nil || block == nil {
+		log.Printf("failed to classify CID %s: %v", _cid.String(), err)
+		return
+	}
+	if !isFile(block) {
+		return
+	}
+	var buf sniffBuffer
+	if err := exporter.writeFile(&buf, _cid, block, ""); err != nil && !errors.Is(err, errSniffed) {
+		log.Printf("failed to classify CID %s: %v", _cid.String(), err)
+		return
+	}
+	f.setContentType(_cid, buf.Bytes(), len(exporter.Missing) == 0)
+}
+
+// classifyPartial detects the type of an incompletely replicated file from its first leaf, if that is replicated.
+// The classification is marked as not confident and replaced once the file is complete.
+func (f *IPFSFetcher) classifyPartial(file cid.Cid) {
+	exporter := NewExporter(f.graph, f.DownloadPath)
+	block, err := exporter.block(file)
+	if err != nil {
+		log.Printf("failed to classify CID %s: %v", file.String(), err)
+		return
+	}
+	if block == nil || !isFile(block) {
+		return
+	}
+	leaf := file
+	for len(block.links) > 0 {
+		leaf = block.links[0].cid
+		if block, err = exporter.block(leaf); err != nil {
+			log.Printf("failed to classify CID %s: %v", file.String(), err)
+			return
+		}
+		if block == nil {
+			return
+		}
+	}
+	var buf sniffBuffer
+	if err := exporter.writeFile(&buf, leaf, block, ""); err != nil && !errors.Is(err, errSniffed) {
+		log.Printf("failed to classify CID %s: %v", file.String(), err)
+		return
+	}
+	if len(exporter.Missing) == 0 {
+		f.setContentType(file, buf.Bytes(), false)
+	}
+}
+
+// setContentType stores the detected type of a file on its node. A confident classification is never replaced
+// by one that is not.
+func (f *IPFSFetcher) setContentType(_cid cid.Cid, data []byte, confident bool) {
+	if len(data) == 0 {
+		return
+	}
+	mimeType, category := detectContentType(data)
+	where := ""
+	if !confident {
+		where = " WHERE NOT coalesce(b.content_confident, false)"
+	}
+	if _, err := f.graph.Query(fmt.Sprintf(
+		"MATCH (b:Block {cid: '%s'})%s SET b.content_type = %s, b.content_category = '%s', b.content_confident = %t",
+		_cid.String(), where, rg.ToString(mimeType), category, confident,
+	)); err != nil {
+		log.Fatalf("failed to set content type of CID %s: %v", _cid.String(), err)
+	}
+	log.Printf("Classified CID %s as %s (%s).", _cid.String(), mimeType, category)
+}
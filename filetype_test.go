@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/korovkin/limiter"
+	rg "github.com/redislabs/redisgraph-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectContentType(t *testing.T) {
+	tar := make([]byte, 512)
+	copy(tar[257:], "ustar")
+	pe := make([]byte, 512)
+	copy(pe, "MZ")
+	pe[0x3C] = 0x80
+	copy(pe[0x80:], "PE\x00\x00")
+
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		mimeType string
+		category string
+	}{
+		{"png", []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR"), "image/png", "image"},
+		{"pdf", []byte("%PDF-1.7\n"), "application/pdf", "document"},
+		{"text", []byte("hello world\n"), "text/plain", "text"},
+		{"html", []byte("<!DOCTYPE html><html></html>"), "text/html", "text"},
+		{"zip", []byte("PK\x03\x04\x14\x00"), "application/zip", "archive"},
+		{"tar", tar, "application/x-tar", "archive"},
+		{"zstd", []byte("\x28\xB5\x2F\xFD\x00\x00"), "application/zstd", "archive"},
+		{"elf", []byte("\x7FELF\x02\x01\x01"), "application/x-executable", "executable"},
+		{"pe", pe, "application/vnd.microsoft.portable-executable", "executable"},
+		{"mz without pe header", []byte("MZ is not an executable\n"), "text/plain", "text"},
+		{"mp4", []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), "video/mp4", "video"},
+		{"binary", []byte{0x00, 0xFF, 0x00, 0xFF}, "application/octet-stream", "unknown"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mimeType, category := detectContentType(tc.data)
+			assert.Equal(t, tc.mimeType, mimeType)
+			assert.Equal(t, tc.category, category)
+		})
+	}
+}
+
+func TestSniffBuffer(t *testing.T) {
+	var buf sniffBuffer
+	n, err := buf.Write(bytes.Repeat([]byte{1}, 500))
+	assert.Equal(t, 500, n)
+	assert.Nil(t, err)
+	n, err = buf.Write(bytes.Repeat([]byte{2}, 100))
+	assert.Equal(t, 12, n)
+	assert.ErrorIs(t, err, errSniffed)
+	assert.Equal(t, sniffLen, buf.Len())
+}
+
+func TestSniffBuffer_WriteFile(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+
+	// the first leaf is larger than the copy buffer of io.Copy, the data of the second one was never written
+	_, err := graphTest.Query(fmt.Sprintf(
+		"CREATE (f:Block {cid: '%s', codec: 'dag-pb', type: 'File', state: '%s'}), "+
+			"(f)-[:has {index: 0}]->(:Block {cid: '%s', codec: 'raw', type: 'Raw', state: '%s'}), "+
+			"(f)-[:has {index: 1}]->(:Block {cid: '%s', codec: 'raw', type: 'Raw', state: '%s'})",
+		fileCID, StateComplete, rawCID, StateComplete, otherRawCID, StateComplete,
+	))
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(ipfsTestDataPath, rawCID), bytes.Repeat([]byte{1}, 64<<10), 0644))
+
+	var buf sniffBuffer
+	_, ok := interface{}(&buf).(io.ReaderFrom)
+	assert.False(t, ok, "io.Copy must not bypass Write")
+
+	exporter := NewExporter(graphPoolTest, ipfsTestDataPath)
+	block, err := exporter.block(cid.MustParse(fileCID))
+	assert.Nil(t, err)
+	assert.ErrorIs(t, exporter.writeFile(&buf, cid.MustParse(fileCID), block, ""), errSniffed)
+	assert.Equal(t, sniffLen, buf.Len())
+	// reading stopped in the first leaf, so the missing second leaf was never reached
+	assert.Empty(t, exporter.Missing)
+}
+
+func TestIPFSFetcher_Classify(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+
+	fetcher := NewIPFSFetcher(context.Background(), NewMockIPFSNode(), graphPoolTest, ipfsTestDataPath, FetchLimits{Workers: 2, Network: 2})
+	jobs = limiter.NewConcurrencyLimiter(1)
+	fetcher.Download(cid.MustParse(directoryCID), "")
+	jobs.WaitAndClose()
+
+	for _, c := range []string{fileCID, yetAnotherRawCID} {
+		res, err := graphTest.Query(fmt.Sprintf("MATCH (b:Block { cid: '%s' }) RETURN b", c))
+		assert.Nil(t, err)
+		assert.True(t, res.Next())
+		b := res.Record().GetByIndex(0).(*rg.Node)
+		assert.Equal(t, "application/octet-stream", b.GetProperty("content_type"))
+		assert.Equal(t, "unknown", b.GetProperty("content_category"))
+		assert.Equal(t, true, b.GetProperty("content_confident"))
+	}
+
+	// chunks of a file are not classified on their own
+	res, err := graphTest.Query(fmt.Sprintf("MATCH (b:Block { cid: '%s' }) RETURN b.content_type", rawCID))
+	assert.Nil(t, err)
+	assert.True(t, res.Next())
+	assert.Nil(t, res.Record().GetByIndex(0))
+
+	// files completed by disk write jobs after Download returned leave no marks behind
+	res, err = graphTest.Query("MATCH (b:Block) WHERE b.unclassified = true RETURN count(b)")
+	assert.Nil(t, err)
+	assert.True(t, res.Next())
+	assert.Equal(t, 0, res.Record().GetByIndex(0))
+}
+
+func TestIPFSFetcher_ClassifyPartial(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+
+	// the last chunk of the file in the directory is corrupt, so the file stays incomplete
+	fetcher := NewIPFSFetcher(context.Background(), &corruptIPFSNode{NewMockIPFSNode()}, graphPoolTest, ipfsTestDataPath,
+		FetchLimits{Workers: 2, Network: 2})
+	// chunks are written after Download returns, so the file is classified when the directory is requested again
+	for i := 0; i < 2; i++ {
+		jobs = limiter.NewConcurrencyLimiter(1)
+		fetcher.Download(cid.MustParse(directoryCID), "")
+		jobs.WaitAndClose()
+	}
+
+	res, err := graphTest.Query(fmt.Sprintf(
+		"MATCH (b:Block { cid: '%s' }) RETURN b.state, b.content_type, b.content_confident", fileCID,
+	))
+	assert.Nil(t, err)
+	assert.True(t, res.Next())
+	assert.Equal(t, []interface{}{StateExpanded, "application/octet-stream", false}, res.Record().Values())
+	// the file stays marked, so that it is classified from its reassembled bytes once it completes
+	assert.True(t, fetcher.unclassified(cid.MustParse(fileCID)))
+}
+
+func TestIPFSFetcher_ClassifyRetry(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+
+	// the last chunk of the file is corrupt, so it fails and is retried on its own
+	fetcher := NewIPFSFetcher(context.Background(), &corruptIPFSNode{NewMockIPFSNode()}, graphPoolTest, ipfsTestDataPath,
+		FetchLimits{Workers: 2, Network: 2})
+	jobs = limiter.NewConcurrencyLimiter(1)
+	fetcher.Download(cid.MustParse(fileCID), "")
+	jobs.WaitAndClose()
+
+	fetcher = NewIPFSFetcher(context.Background(), NewMockIPFSNode(), graphPoolTest, ipfsTestDataPath,
+		FetchLimits{Workers: 2, Network: 2})
+	jobs = limiter.NewConcurrencyLimiter(1)
+	fetcher.Retry(cid.MustParse(otherRawCID))
+	jobs.WaitAndClose()
+
+	res, err := graphTest.Query(fmt.Sprintf(
+		"MATCH (f:Block { cid: '%s' }), (c:Block { cid: '%s' }) RETURN f.state, f.content_confident, c.state, c.content_type",
+		fileCID, otherRawCID,
+	))
+	assert.Nil(t, err)
+	assert.True(t, res.Next())
+	// the retried chunk completes the file, but is not classified as a file itself
+	assert.Equal(t, []interface{}{StateComplete, true, StateComplete, nil}, res.Record().Values())
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	"github.com/multiformats/go-multicodec"
+)
+
+// Filter actions.
+const (
+	FilterInclude = "include"
+	FilterExclude = "exclude"
+)
+
+// defaultRuleName is the counter name for entries that did not match any rule.
+const defaultRuleName = "(default)"
+
+// filterMatches counts, per rule, the wantlist entries that the rule decided on.
+var filterMatches = expvar.NewMap("filter_rule_matches")
+
+// FilterRule decides whether matching wantlist entries are fetched. All given criteria must match for a rule
+// to match; omitted criteria match every entry.
+type FilterRule struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	// Peers are peer IDs.
+	Peers []string `json:"peers,omitempty"`
+	// CIDVersions are CID versions (0 or 1).
+	CIDVersions []uint64 `json:"cid_versions,omitempty"`
+	// Codecs are multicodec names, e.g. dag-pb or raw.
+	Codecs []string `json:"codecs,omitempty"`
+	// MultihashFunctions are multicodec names of hash functions, e.g. sha2-256 or blake2b-256.
+	MultihashFunctions []string `json:"multihash_functions,omitempty"`
+	// WantTypes are Bitswap want types (Block or Have).
+	WantTypes    []string `json:"want_types,omitempty"`
+	Cancel       *bool    `json:"cancel,omitempty"`
+	FullWantList *bool    `json:"full_wantlist,omitempty"`
+}
+
+// FilterConfig is the format of the filter configuration file.
+type FilterConfig struct {
+	// Default is the action for entries that do not match any rule (include if omitted).
+	Default string       `json:"default,omitempty"`
+	Rules   []FilterRule `json:"rules"`
+}
+
+// EventFilter decides which wantlist entries are scheduled for fetching. Rules are evaluated in order and the
+// first matching rule decides.
+type EventFilter struct {
+	config FilterConfig
+}
+
+// LoadEventFilter reads and validates the filter configuration at path.
+func LoadEventFilter(path string) (*EventFilter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config FilterConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return NewEventFilter(config)
+}
+
+// NewEventFilter validates config and creates an EventFilter from it.
+func NewEventFilter(config FilterConfig) (*EventFilter, error) {
+	if config.Default == "" {
+		config.Default = FilterInclude
+	}
+	if err := validateAction(config.Default); err != nil {
+		return nil, err
+	}
+	for i, rule := range config.Rules {
+		if rule.Name == "" {
+			config.Rules[i].Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if err := validateAction(rule.Action); err != nil {
+			return nil, fmt.Errorf("%s: %w", config.Rules[i].Name, err)
+		}
+		for _, name := range append(append([]string{}, rule.Codecs...), rule.MultihashFunctions...) {
+			var code multicodec.Code
+			if err := code.Set(name); err != nil {
+				return nil, fmt.Errorf("%s: %w", config.Rules[i].Name, err)
+			}
+		}
+		for _, wantType := range rule.WantTypes {
+			if !strings.EqualFold(wantType, "Block") && !strings.EqualFold(wantType, "Have") {
+				return nil, fmt.Errorf("%s: unknown want type %s", config.Rules[i].Name, wantType)
+			}
+		}
+	}
+	return &EventFilter{config: config}, nil
+}
+
+func validateAction(action string) error {
+	if action != FilterInclude && action != FilterExclude {
+		return fmt.Errorf("unknown filter action %q", action)
+	}
+	return nil
+}
+
+// Allow reports whether the wantlist entry of an event should be fetched. A nil filter allows everything.
+func (f *EventFilter) Allow(ev Event, entry bsmsg.Entry) bool {
+	if f == nil {
+		return true
+	}
+	for _, rule := range f.config.Rules {
+		if rule.matches(ev, entry) {
+			filterMatches.Add(rule.Name, 1)
+			return rule.Action == FilterInclude
+		}
+	}
+	filterMatches.Add(defaultRuleName, 1)
+	return f.config.Default == FilterInclude
+}
+
+// matches reports whether all criteria of the rule apply to the entry.
+func (r *FilterRule) matches(ev Event, entry bsmsg.Entry) bool {
+	prefix := entry.Cid.Prefix()
+	return matchAny(r.Peers, ev.Peer, equal[string]) &&
+		matchAny(r.CIDVersions, prefix.Version, equal[uint64]) &&
+		matchAny(r.Codecs, multicodec.Code(prefix.Codec).String(), strings.EqualFold) &&
+		matchAny(r.MultihashFunctions, multicodec.Code(prefix.MhType).String(), strings.EqualFold) &&
+		matchAny(r.WantTypes, entry.WantType.String(), strings.EqualFold) &&
+		(r.Cancel == nil || *r.Cancel == entry.Cancel) &&
+		(r.FullWantList == nil || *r.FullWantList == ev.BitswapMessage.FullWantList)
+}
+
+// matchAny reports whether v equals any of the options, or whether there are no options at all.
+func matchAny[T any](options []T, v T, equal func(a, b T) bool) bool {
+	if len(options) == 0 {
+		return true
+	}
+	for _, o := range options {
+		if equal(o, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func equal[T comparable](a, b T) bool {
+	return a == b
+}
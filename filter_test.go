@@ -0,0 +1,78 @@
+package main
+
+import (
+	"expvar"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func wantEntry(c string, wantType pb.Message_Wantlist_WantType, cancel bool) bsmsg.Entry {
+	var e bsmsg.Entry
+	e.Cid, e.WantType, e.Cancel = cid.MustParse(c), wantType, cancel
+	return e
+}
+
+func TestEventFilter_Allow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`{
+		"default": "exclude",
+		"rules": [
+			{"name": "no-cancels", "action": "exclude", "cancel": true},
+			{"name": "blocked-peer", "action": "exclude", "peers": ["12D3KooWBad"]},
+			{"name": "v0-dag-pb", "action": "include", "cid_versions": [0], "codecs": ["dag-pb"]},
+			{"name": "blake2b", "action": "include", "multihash_functions": ["blake2b-256"], "want_types": ["have"]}
+		]
+	}`), 0644))
+	filter, err := LoadEventFilter(path)
+	assert.Nil(t, err)
+
+	before := map[string]int64{}
+	for _, name := range []string{"no-cancels", "blocked-peer", "v0-dag-pb", "blake2b", defaultRuleName} {
+		before[name] = filterMatchCount(name)
+	}
+
+	ev := Event{Peer: "12D3KooWGood"}
+
+	assert.True(t, filter.Allow(ev, wantEntry(directoryCID, pb.Message_Wantlist_Block, false)))
+	assert.False(t, filter.Allow(ev, wantEntry(directoryCID, pb.Message_Wantlist_Block, true)))
+	assert.False(t, filter.Allow(Event{Peer: "12D3KooWBad"}, wantEntry(directoryCID, pb.Message_Wantlist_Block, false)))
+	assert.True(t, filter.Allow(ev, wantEntry(yetAnotherRawCID, pb.Message_Wantlist_Have, false)))
+	assert.False(t, filter.Allow(ev, wantEntry(yetAnotherRawCID, pb.Message_Wantlist_Block, false)))
+	assert.False(t, filter.Allow(ev, wantEntry(rawCID, pb.Message_Wantlist_Block, false)))
+	assert.True(t, (*EventFilter)(nil).Allow(ev, wantEntry(rawCID, pb.Message_Wantlist_Block, false)))
+
+	t.Run("matches are counted per rule", func(t *testing.T) {
+		for name, matches := range map[string]int64{
+			"no-cancels":    1,
+			"blocked-peer":  1,
+			"v0-dag-pb":     1,
+			"blake2b":       1,
+			defaultRuleName: 2,
+		} {
+			assert.Equal(t, before[name]+matches, filterMatchCount(name), name)
+		}
+	})
+}
+
+// filterMatchCount returns the number of matches of a rule counted in filter_rule_matches.
+func filterMatchCount(name string) int64 {
+	if v, ok := filterMatches.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestNewEventFilter_Invalid(t *testing.T) {
+	_, err := NewEventFilter(FilterConfig{Rules: []FilterRule{{Action: "maybe"}}})
+	assert.ErrorContains(t, err, "rule-1")
+	_, err = NewEventFilter(FilterConfig{Rules: []FilterRule{{Action: FilterInclude, Codecs: []string{"dag-nope"}}}})
+	assert.NotNil(t, err)
+	_, err = NewEventFilter(FilterConfig{Rules: []FilterRule{{Action: FilterInclude, WantTypes: []string{"want"}}}})
+	assert.NotNil(t, err)
+}
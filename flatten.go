@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// flatColumns are the columns of the flattened event export.
+var flatColumns = []string{"timestamp", "peer", "cid", "want_type", "cancel", "priority", "monitor"}
+
+// flattenEvent turns an event into one row per wantlist entry.
+func flattenEvent(ev Event) [][]string {
+	rows := make([][]string, 0, len(ev.BitswapMessage.WantlistEntries))
+	for _, entry := range ev.BitswapMessage.WantlistEntries {
+		rows = append(rows, []string{
+			ev.Timestamp.UTC().Format(time.RFC3339Nano),
+			ev.Peer,
+			entry.Cid.String(),
+			entry.WantType.String(),
+			strconv.FormatBool(entry.Cancel),
+			strconv.Itoa(int(entry.Priority)),
+			ev.Monitor,
+		})
+	}
+	return rows
+}
+
+// CSVExporter writes flattened events as CSV files that are partitioned by the hour of the event timestamp,
+// i.e. into dir/date=YYYY-MM-DD/hour=HH/events.csv. The hive-style layout lets analytics tools load and
+// prune partitions without parsing the nested event logs. Only the partitions of the latest and the previous
+// hour are kept open; late events for earlier hours reopen their partition for the batch.
+type CSVExporter struct {
+	dir string
+
+	mu         sync.Mutex
+	partitions map[string]*csvPartition
+	// latest is the hour of the latest event.
+	latest time.Time
+}
+
+// csvPartition is an open partition file.
+type csvPartition struct {
+	hour time.Time
+	file *os.File
+	w    *csv.Writer
+}
+
+// NewCSVExporter creates an exporter that writes partitions into dir.
+func NewCSVExporter(dir string) *CSVExporter {
+	return &CSVExporter{dir: dir, partitions: make(map[string]*csvPartition)}
+}
+
+// Write appends the rows of a batch of events to their partitions.
+func (e *CSVExporter) Write(events []Event) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	touched := make(map[*csvPartition]bool)
+	for _, ev := range events {
+		rows := flattenEvent(ev)
+		if len(rows) == 0 {
+			continue
+		}
+		partition, err := e.partition(ev.Timestamp)
+		if err != nil {
+			return err
+		}
+		if err := partition.w.WriteAll(rows); err != nil {
+			return err
+		}
+		touched[partition] = true
+	}
+	for partition := range touched {
+		partition.w.Flush()
+		if err := partition.w.Error(); err != nil {
+			return err
+		}
+	}
+	return e.closePartitions(e.latest.Add(-time.Hour))
+}
+
+// partition returns the open partition for the hour of ts, creating it if necessary.
+func (e *CSVExporter) partition(ts time.Time) (*csvPartition, error) {
+	ts = ts.UTC()
+	hour := ts.Truncate(time.Hour)
+	if hour.After(e.latest) {
+		e.latest = hour
+	}
+	path := filepath.Join(e.dir, "date="+ts.Format("2006-01-02"), "hour="+ts.Format("15"), "events.csv")
+	if partition, ok := e.partitions[path]; ok {
+		return partition, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	partition := &csvPartition{hour: hour, file: file, w: csv.NewWriter(file)}
+	if info.Size() == 0 {
+		if err := partition.w.Write(flatColumns); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	e.partitions[path] = partition
+	return partition, nil
+}
+
+// Close flushes and closes all partitions.
+func (e *CSVExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.closePartitions(time.Time{})
+}
+
+// closePartitions flushes and closes the partitions of hours before the given hour (all partitions for the
+// zero time).
+func (e *CSVExporter) closePartitions(before time.Time) error {
+	var firstErr error
+	for path, partition := range e.partitions {
+		if !before.IsZero() && !partition.hour.Before(before) {
+			continue
+		}
+		partition.w.Flush()
+		if err := partition.w.Error(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := partition.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(e.partitions, path)
+	}
+	return firstErr
+}
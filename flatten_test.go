@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlattenEvent(t *testing.T) {
+	ev := testEvents(t)[1]
+	ev.Monitor = "monitor_01"
+
+	rows := flattenEvent(ev)
+	assert.Equal(t, [][]string{
+		{"2023-01-19T10:00:01Z", "12D3KooWB", fileCID, "Have", "false", "1", "monitor_01"},
+	}, rows)
+}
+
+func TestCSVExporter_Write(t *testing.T) {
+	dir := t.TempDir()
+	events := testEvents(t)
+
+	// writing twice appends to the existing partition without repeating the header
+	for i := 0; i < 2; i++ {
+		exporter := NewCSVExporter(dir)
+		assert.Nil(t, exporter.Write(events))
+		assert.Nil(t, exporter.Close())
+	}
+
+	f, err := os.Open(filepath.Join(dir, "date=2023-01-19", "hour=10", "events.csv"))
+	assert.Nil(t, err)
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	assert.Nil(t, err)
+	assert.Len(t, records, 5)
+	assert.Equal(t, flatColumns, records[0])
+	assert.Equal(t, rawCID, records[1][2])
+	assert.Equal(t, "Block", records[1][3])
+	assert.Equal(t, fileCID, records[4][2])
+}
+
+func TestCSVExporter_ClosePartitions(t *testing.T) {
+	exporter := NewCSVExporter(t.TempDir())
+	ev := testEvents(t)[0]
+	start := ev.Timestamp
+
+	for i := 0; i < 5; i++ {
+		ev.Timestamp = start.Add(time.Duration(i) * time.Hour)
+		assert.Nil(t, exporter.Write([]Event{ev}))
+	}
+	assert.Len(t, exporter.partitions, 2)
+
+	// a late event reopens its partition only for the batch
+	ev.Timestamp = start
+	assert.Nil(t, exporter.Write([]Event{ev}))
+	assert.Len(t, exporter.partitions, 2)
+
+	assert.Nil(t, exporter.Close())
+	assert.Empty(t, exporter.partitions)
+
+	f, err := os.Open(filepath.Join(exporter.dir, "date=2023-01-19", "hour=10", "events.csv"))
+	assert.Nil(t, err)
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	assert.Nil(t, err)
+	assert.Len(t, records, 3)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/ipfs/go-cid"
+)
+
+// visit is a block in the frontier of a traversal.
+type visit struct {
+	cid cid.Cid
+	// depth is the distance of the block from the root of the traversal.
+	depth int
+	// traversal is the traversal of the root that the block was reached from.
+	traversal *traversal
+}
+
+// frontier is the queue of blocks of breadth-first traversals that are yet to be expanded. It is shared by the
+// workers of the traversals and tracks how many blocks are being expanded, so that workers know when the
+// traversals are complete.
+type frontier struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    []visit
+	inflight int
+}
+
+func newFrontier(visits ...visit) *frontier {
+	q := &frontier{queue: visits}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push appends blocks to the frontier.
+func (q *frontier) push(visits ...visit) {
+	if len(visits) == 0 {
+		return
+	}
+	q.mu.Lock()
+	q.queue = append(q.queue, visits...)
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// pop takes the next block off the frontier, waiting while other workers may still push blocks. It returns false
+// once the traversal is complete. Every popped block must be acknowledged with done after its children were pushed.
+func (q *frontier) pop() (visit, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.queue) == 0 && q.inflight > 0 {
+		q.cond.Wait()
+	}
+	if len(q.queue) == 0 {
+		return visit{}, false
+	}
+	v := q.queue[0]
+	q.queue[0] = visit{}
+	q.queue = q.queue[1:]
+	q.inflight++
+	return v, true
+}
+
+// done acknowledges that a popped block has been expanded.
+func (q *frontier) done() {
+	q.mu.Lock()
+	q.inflight--
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrontier(t *testing.T) {
+	// a tree in which every block up to depth 3 links to the same three children
+	children := []cid.Cid{cid.MustParse(rawCID), cid.MustParse(otherRawCID), cid.MustParse(yetAnotherRawCID)}
+	q := newFrontier(visit{cid: cid.MustParse(fileCID)})
+
+	var mu sync.Mutex
+	depths := map[int]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				v, ok := q.pop()
+				if !ok {
+					return
+				}
+				mu.Lock()
+				depths[v.depth]++
+				mu.Unlock()
+				if v.depth < 3 {
+					for _, c := range children {
+						q.push(visit{cid: c, depth: v.depth + 1})
+					}
+				}
+				q.done()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, map[int]int{0: 1, 1: 3, 2: 9, 3: 27}, depths)
+	_, ok := q.pop()
+	assert.False(t, ok)
+}
@@ -1,11 +1,42 @@
 package main
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+
 	"github.com/ipfs/go-cid"
 	"github.com/multiformats/go-multicodec"
 	rg "github.com/redislabs/redisgraph-go"
 )
 
+// GraphQuerier executes Cypher queries against the graph database. It is implemented by *rg.Graph.
+type GraphQuerier interface {
+	Query(q string) (*rg.QueryResult, error)
+}
+
+// GraphPool spreads queries over several connections to the graph database. The number of connections bounds
+// the number of concurrent graph writes.
+type GraphPool struct {
+	graphs chan GraphQuerier
+}
+
+// NewGraphPool creates a pool of graphs, each of which is used by one query at a time.
+func NewGraphPool(graphs ...GraphQuerier) *GraphPool {
+	p := &GraphPool{graphs: make(chan GraphQuerier, len(graphs))}
+	for _, g := range graphs {
+		p.graphs <- g
+	}
+	return p
+}
+
+// Query implements GraphQuerier.
+func (p *GraphPool) Query(q string) (*rg.QueryResult, error) {
+	g := <-p.graphs
+	defer func() { p.graphs <- g }()
+	return g.Query(q)
+}
+
 // newNode creates a new redis graph node struct.
 func newNode(_cid cid.Cid) *rg.Node {
 	return rg.NodeNew("Block", _cid.String(), map[string]interface{}{
@@ -13,3 +44,39 @@ func newNode(_cid cid.Cid) *rg.Node {
 		"codec": multicodec.Code(_cid.Type()).String(),
 	})
 }
+
+// onCreateSetMonitor returns a MERGE clause suffix that tags a newly created entity with the observing monitor.
+func onCreateSetMonitor(alias string, monitor string) string {
+	if monitor == "" {
+		return ""
+	}
+	return fmt.Sprintf(" ON CREATE SET %s.monitor = %s", alias, rg.ToString(monitor))
+}
+
+// encodeProperties encodes properties as a Cypher map literal (with deterministic key order).
+func encodeProperties(props map[string]interface{}) string {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + ": " + rg.ToString(props[k])
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// setProperties encodes properties as the assignments of a Cypher SET clause (with deterministic key order).
+func setProperties(alias string, props map[string]interface{}) string {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	assignments := make([]string, len(keys))
+	for i, k := range keys {
+		assignments[i] = alias + "." + k + " = " + rg.ToString(props[k])
+	}
+	return strings.Join(assignments, ", ")
+}
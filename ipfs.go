@@ -4,21 +4,17 @@ import (
 	"context"
 	ipfslite "github.com/hsanjuan/ipfs-lite"
 	"github.com/ipfs/go-cid"
-	format "github.com/ipfs/go-ipld-format"
-	"github.com/ipfs/go-merkledag"
-	ft "github.com/ipfs/go-unixfs"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/multiformats/go-multiaddr"
 	"io"
-	"log"
 )
 
 // IPFSNode
 type IPFSNode interface {
 	GetFile(_cid cid.Cid) (res []byte, err error)
-	GetDAG(_cid cid.Cid) (fsNode *ft.FSNode, links []*format.Link, err error)
+	GetBlock(_cid cid.Cid) (data []byte, err error)
 }
 
 // IPFSNodeImpl is an implementation of the IPFSNode node.
@@ -73,23 +69,13 @@ func (n *IPFSNodeImpl) GetFile(_cid cid.Cid) ([]byte, error) {
 	return io.ReadAll(rsc)
 }
 
-// GetDAG returns the links of a block and in case it's a Protobuf, also the FSNode.
-func (n *IPFSNodeImpl) GetDAG(_cid cid.Cid) (node *ft.FSNode, links []*format.Link, err error) {
-	log.Println("Get DAG for " + _cid.String())
+// GetBlock returns the raw data of a block as it is encoded by the codec of its CID.
+func (n *IPFSNodeImpl) GetBlock(_cid cid.Cid) ([]byte, error) {
 	ctx, cancel := context.WithTimeout(n.ctx, ipfsTimeout)
 	defer cancel()
-
-	var dag format.Node
-	dag, err = n.peer.DAGService.Get(ctx, _cid)
+	block, err := n.peer.BlockService().GetBlock(ctx, _cid)
 	if err != nil {
-		return
-	}
-	links = dag.Links()
-	if dag.Cid().Type() == cid.DagProtobuf {
-		if pn, ok := dag.(*merkledag.ProtoNode); ok {
-			node, err = ft.FSNodeFromBytes(pn.Data())
-			return
-		}
+		return nil, err
 	}
-	return
+	return block.RawData(), nil
 }
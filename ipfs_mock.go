@@ -1,21 +1,37 @@
 package main
 
 import (
+	"encoding/hex"
 	"errors"
 	"github.com/ipfs/go-cid"
-	format "github.com/ipfs/go-ipld-format"
-	ft "github.com/ipfs/go-unixfs"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 const (
-	rawCID           = "bafkreictqudr3cfhwkobq4jqmlzvkhr6nnopgv47hr3l3dy4cg5es4o7d4"    // 0x00FF00FF
-	otherRawCID      = "bafkreifypznnfdih7jirykt32aleub7q3pommoypvqo6ovk3upelzmgq7u"    // 0xFFFFFFFF
-	yetAnotherRawCID = "bafk2bzaceatgshdb7uzpl26uxsxen3lduhr635j6qhxbntilygtvraucju26a" // 0xFF00FF00
-	fileCID          = "bafybeihis42cbqzrlacahelswxbxhs62jn45gisz72beo7i6lhu2nmbezq"    // [ rawCID, rawCID, otherRawCID ]
-	directoryCID     = "QmSnuWmxptJZdLJpKRarxBMS2Ju2oANVrgbr2xWbie9b2D"                 // [ fileCID, yetAnotherRawCID ]
+	rawCID           = "bafkreid2pp2fjrptzmnz3gra7akbp6mns5x6hm65kla3tfupaluj47ukf4"    // 0x00FF00FF
+	otherRawCID      = "bafkreifnsujrxqfxthaldl2hp6yu7tzgu2u7oydz4sf7befmw7udm675by"    // 0xFFFFFFFF
+	yetAnotherRawCID = "bafk2bzacea2kua2hs665f6kcmsh5emrcv7sgfckmd377bvr77vrtxotiligcc" // 0xFF00FF00
+	fileCID          = "bafybeidz7kgzr5j2g5tvautjkvwalgqlm3vnryxhxfrme5gr2gusk65oiq"    // [ rawCID, rawCID, otherRawCID ]
+	directoryCID     = "Qmd16QvhKH7AmnQbfC3i1GLKQrLw5vyEJpXFMDMqMAES5T"                 // [ fileCID, yetAnotherRawCID ]
+	cborCID          = "bafyreieqtcboufu2flu7mflqpfhcfkhdjeik7nnnpgab5yxxruluvx3miy"    // {"chunks": [ rawCID, otherRawCID ], "name": "example"}
+	gitCID           = "baf4beifdnwnxiczyqas4ozplypn2obmyruuiykjolwdzx562whxphee5f4"    // git-raw "blob 4\x00abcd"
+	ethBlockCID      = "bagiacerardkcm36u4yzy2e5yix6pfckxtuqjzclyeo4sc7nd4fqzg3ydcweq"  // eth-block "abcd" (cannot be decoded)
 )
 
+// cborBlock is the dag-cbor encoded block of cborCID.
+const cborBlock = "a2646e616d65676578616d706c65666368756e6b7382d82a582500015512207a7bf454c5f3cb1b9d9a20f81417f98d976fe3b3dd" +
+	"52c1b9968f02e89e7e8a2fd82a58250001551220ad95131bc0b799c0b1af477fb14fcf26a6a9f76079e48bf090acb7e8367bfd0e"
+
+// fileBlock is the dag-pb encoded block of fileCID.
+const fileBlock = "122a0a24015512207a7bf454c5f3cb1b9d9a20f81417f98d976fe3b3dd52c1b9968f02e89e7e8a2f12001804122a0a2401" +
+	"5512207a7bf454c5f3cb1b9d9a20f81417f98d976fe3b3dd52c1b9968f02e89e7e8a2f12001804122a0a2401551220ad95131bc0b799c0b1af" +
+	"477fb14fcf26a6a9f76079e48bf090acb7e8367bfd0e120018040a0a0802180c200420042004"
+
+// directoryBlock is the dag-pb encoded block of directoryCID.
+const directoryBlock = "12320a240170122079fa8d98f53a3767505269556c059a0b66ead8e2e7b962c274d1d1a9257bae44120866696c652e62" +
+	"696e180c12350a260155a0e4022034aa034797bdd2f942648fd23222afe462894c1efff0d63ffd633bba685a0c2112096f746865722e6269" +
+	"6e18040a0408011800"
+
 // MockIPFSNode is a mocked implementation of the IPFSNode node used for testing.
 type MockIPFSNode struct{}
 
@@ -36,20 +52,19 @@ func (n *MockIPFSNode) GetFile(_cid cid.Cid) (res []byte, err error) {
 	}
 }
 
-func (n *MockIPFSNode) GetDAG(_cid cid.Cid) (*ft.FSNode, []*format.Link, error) {
+func (n *MockIPFSNode) GetBlock(_cid cid.Cid) ([]byte, error) {
 	switch _cid.String() {
 	case fileCID:
-		return nil, []*format.Link{
-			{Cid: cid.MustParse(rawCID)},
-			{Cid: cid.MustParse(rawCID)},
-			{Cid: cid.MustParse(otherRawCID)},
-		}, nil
+		return hex.DecodeString(fileBlock)
 	case directoryCID:
-		return nil, []*format.Link{
-			{Cid: cid.MustParse(fileCID)},
-			{Cid: cid.MustParse(yetAnotherRawCID)},
-		}, nil
+		return hex.DecodeString(directoryBlock)
+	case cborCID:
+		return hex.DecodeString(cborBlock)
+	case gitCID:
+		return []byte("blob 4\x00abcd"), nil
+	case ethBlockCID:
+		return []byte("abcd"), nil
 	default:
-		return nil, nil, errors.New("invalid cid")
+		return n.GetFile(_cid)
 	}
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	_ "github.com/ceramicnetwork/go-dag-jose/dagjose"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	_ "github.com/ipfs/go-ipld-git"
+	_ "github.com/ipld/go-ipld-prime/codec/cbor"
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+	_ "github.com/ipld/go-ipld-prime/codec/dagjson"
+	_ "github.com/ipld/go-ipld-prime/codec/json"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipldcodec "github.com/ipld/go-ipld-prime/multicodec"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/multiformats/go-multicodec"
+)
+
+// errUnknownCodec is returned for blocks whose codec cannot be decoded.
+var errUnknownCodec = errors.New("unknown codec")
+
+// decodeIPLD decodes the data of a block with the codec of its CID into the IPLD data model.
+func decodeIPLD(_cid cid.Cid, data []byte) (datamodel.Node, error) {
+	decode, err := ipldcodec.LookupDecoder(_cid.Prefix().Codec)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s", errUnknownCodec, multicodec.Code(_cid.Prefix().Codec).String())
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := decode(nb, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return nb.Build(), nil
+}
+
+// ipldLinks returns the links of a decoded block in the order of the block. Links are named by their path
+// within the block, e.g. "chunks/0".
+func ipldLinks(node datamodel.Node) ([]*format.Link, error) {
+	var links []*format.Link
+	err := collectLinks(node, datamodel.Path{}, &links)
+	return links, err
+}
+
+// collectLinks appends the links in node at path to links.
+func collectLinks(node datamodel.Node, path datamodel.Path, links *[]*format.Link) error {
+	switch node.Kind() {
+	case datamodel.Kind_Link:
+		link, err := node.AsLink()
+		if err != nil {
+			return err
+		}
+		if l, ok := link.(cidlink.Link); ok {
+			*links = append(*links, &format.Link{Name: path.String(), Cid: l.Cid})
+		}
+	case datamodel.Kind_Map:
+		it := node.MapIterator()
+		for !it.Done() {
+			k, v, err := it.Next()
+			if err != nil {
+				return err
+			}
+			key, err := k.AsString()
+			if err != nil {
+				return err
+			}
+			if err := collectLinks(v, path.AppendSegmentString(key), links); err != nil {
+				return err
+			}
+		}
+	case datamodel.Kind_List:
+		it := node.ListIterator()
+		for !it.Done() {
+			i, v, err := it.Next()
+			if err != nil {
+				return err
+			}
+			if err := collectLinks(v, path.AppendSegmentInt(i), links); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/korovkin/limiter"
+	"github.com/multiformats/go-multicodec"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeIPLD(t *testing.T) {
+	t.Run("dag-cbor", func(t *testing.T) {
+		data, err := hex.DecodeString(cborBlock)
+		assert.Nil(t, err)
+		node, err := decodeIPLD(cid.MustParse(cborCID), data)
+		assert.Nil(t, err)
+		assert.Equal(t, "map", node.Kind().String())
+
+		links, err := ipldLinks(node)
+		assert.Nil(t, err)
+		assert.Len(t, links, 2)
+		assert.Equal(t, "chunks/0", links[0].Name)
+		assert.Equal(t, cid.MustParse(rawCID), links[0].Cid)
+		assert.Equal(t, "chunks/1", links[1].Name)
+		assert.Equal(t, cid.MustParse(otherRawCID), links[1].Cid)
+	})
+
+	t.Run("dag-json", func(t *testing.T) {
+		_cid := cid.NewCidV1(uint64(multicodec.DagJson), cid.MustParse(rawCID).Hash())
+		node, err := decodeIPLD(_cid, []byte(fmt.Sprintf(`[{"/": "%s"}, 1, "a"]`, rawCID)))
+		assert.Nil(t, err)
+		assert.Equal(t, "list", node.Kind().String())
+
+		links, err := ipldLinks(node)
+		assert.Nil(t, err)
+		assert.Len(t, links, 1)
+		assert.Equal(t, "0", links[0].Name)
+		assert.Equal(t, cid.MustParse(rawCID), links[0].Cid)
+	})
+
+	t.Run("git", func(t *testing.T) {
+		blob := sha1.Sum([]byte("blob 4\x00abcd"))
+		entry := append([]byte("100644 file.txt\x00"), blob[:]...)
+		tree := append([]byte(fmt.Sprintf("tree %d\x00", len(entry))), entry...)
+		node, err := decodeIPLD(cid.NewCidV1(cid.GitRaw, cid.MustParse(rawCID).Hash()), tree)
+		assert.Nil(t, err)
+		assert.Equal(t, "map", node.Kind().String())
+
+		links, err := ipldLinks(node)
+		assert.Nil(t, err)
+		assert.Len(t, links, 1)
+		assert.Equal(t, "file.txt/hash", links[0].Name)
+		hash, err := mh.Encode(blob[:], mh.SHA1)
+		assert.Nil(t, err)
+		assert.Equal(t, cid.NewCidV1(cid.GitRaw, hash), links[0].Cid)
+	})
+
+	t.Run("dag-jose", func(t *testing.T) {
+		jws, err := qp.BuildMap(basicnode.Prototype.Any, 2, func(ma datamodel.MapAssembler) {
+			qp.MapEntry(ma, "payload", qp.String(base64.RawURLEncoding.EncodeToString(cid.MustParse(rawCID).Bytes())))
+			qp.MapEntry(ma, "signatures", qp.List(1, func(la datamodel.ListAssembler) {
+				qp.ListEntry(la, qp.Map(2, func(ma datamodel.MapAssembler) {
+					qp.MapEntry(ma, "protected", qp.Bytes([]byte(`{"alg":"EdDSA"}`)))
+					qp.MapEntry(ma, "signature", qp.Bytes([]byte{0x01, 0x02, 0x03}))
+				}))
+			}))
+		})
+		assert.Nil(t, err)
+		var data bytes.Buffer
+		assert.Nil(t, dagcbor.Encode(jws, &data))
+
+		node, err := decodeIPLD(cid.NewCidV1(uint64(multicodec.DagJose), cid.MustParse(rawCID).Hash()), data.Bytes())
+		assert.Nil(t, err)
+		links, err := ipldLinks(node)
+		assert.Nil(t, err)
+		assert.Len(t, links, 1)
+		assert.Equal(t, "link", links[0].Name)
+		assert.Equal(t, cid.MustParse(rawCID), links[0].Cid)
+	})
+
+	t.Run("unknown codec", func(t *testing.T) {
+		_, err := decodeIPLD(cid.MustParse(ethBlockCID), []byte("abcd"))
+		assert.ErrorIs(t, err, errUnknownCodec)
+	})
+
+	t.Run("malformed block", func(t *testing.T) {
+		_, err := decodeIPLD(cid.MustParse(cborCID), []byte{0xFF})
+		assert.Error(t, err)
+		assert.False(t, errors.Is(err, errUnknownCodec))
+	})
+}
+
+func TestIPFSFetcher_IPLD(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+
+	fetcher := NewIPFSFetcher(context.Background(), NewMockIPFSNode(), graphPoolTest, ipfsTestDataPath, FetchLimits{Workers: 2, Network: 2})
+	jobs = limiter.NewConcurrencyLimiter(1)
+	fetcher.Download(cid.MustParse(cborCID), "")
+	fetcher.Download(cid.MustParse(gitCID), "")
+	fetcher.Download(cid.MustParse(ethBlockCID), "")
+	jobs.WaitAndClose()
+
+	t.Run("links of decoded blocks", func(t *testing.T) {
+		res, err := graphTest.Query(fmt.Sprintf(
+			"MATCH (a:Block { cid: '%s' })-[e:has]->(b:Block) RETURN a.kind, a.state, e.name, b.cid, b.state ORDER BY e.index",
+			cborCID,
+		))
+		assert.Nil(t, err)
+		var links [][]interface{}
+		for res.Next() {
+			links = append(links, res.Record().Values())
+		}
+		assert.Equal(t, [][]interface{}{
+			{"map", StateComplete, "chunks/0", rawCID, StateComplete},
+			{"map", StateComplete, "chunks/1", otherRawCID, StateComplete},
+		}, links)
+
+		// blocks with links are stored as well, so that they can be verified
+		data, err := os.ReadFile(filepath.Join(ipfsTestDataPath, cborCID))
+		assert.Nil(t, err)
+		assert.Nil(t, verifyBlock(cid.MustParse(cborCID), data))
+	})
+
+	t.Run("git blob", func(t *testing.T) {
+		res, err := graphTest.Query(fmt.Sprintf(
+			"MATCH (b:Block { cid: '%s' }) RETURN b.codec, b.kind, b.unknown_codec, b.state", gitCID,
+		))
+		assert.Nil(t, err)
+		assert.True(t, res.Next())
+		assert.Equal(t, []interface{}{"git-raw", "bytes", nil, StateComplete}, res.Record().Values())
+
+		data, err := os.ReadFile(filepath.Join(ipfsTestDataPath, gitCID))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("blob 4\x00abcd"), data)
+	})
+
+	t.Run("unknown codec", func(t *testing.T) {
+		res, err := graphTest.Query(fmt.Sprintf(
+			"MATCH (b:Block { cid: '%s' }) RETURN b.codec, b.unknown_codec, b.state", ethBlockCID,
+		))
+		assert.Nil(t, err)
+		assert.True(t, res.Next())
+		assert.Equal(t, []interface{}{"eth-block", true, StateComplete}, res.Record().Values())
+
+		data, err := os.ReadFile(filepath.Join(ipfsTestDataPath, ethBlockCID))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("abcd"), data)
+	})
+}
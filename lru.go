@@ -0,0 +1,55 @@
+package main
+
+import "container/list"
+
+// LRU is a set of limited capacity that evicts the least recently used value when full.
+type LRU[T comparable] struct {
+	capacity int
+	order    *list.List
+	elements map[T]*list.Element
+}
+
+// NewLRU creates a new empty LRU set holding at most capacity values.
+func NewLRU[T comparable](capacity int) *LRU[T] {
+	return &LRU[T]{
+		capacity: capacity,
+		order:    list.New(),
+		elements: map[T]*list.Element{},
+	}
+}
+
+// Add inserts a value or marks it as most recently used if it already exists.
+func (l *LRU[T]) Add(v T) {
+	if e, ok := l.elements[v]; ok {
+		l.order.MoveToFront(e)
+		return
+	}
+	l.elements[v] = l.order.PushFront(v)
+	if l.order.Len() > l.capacity {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.elements, oldest.Value.(T))
+	}
+}
+
+// Touch checks if a value is present and, if so, marks it as most recently used.
+func (l *LRU[T]) Touch(v T) bool {
+	e, ok := l.elements[v]
+	if ok {
+		l.order.MoveToFront(e)
+	}
+	return ok
+}
+
+// Remove deletes a value from the set if it is present.
+func (l *LRU[T]) Remove(v T) {
+	if e, ok := l.elements[v]; ok {
+		l.order.Remove(e)
+		delete(l.elements, v)
+	}
+}
+
+// Size returns the number of values in the set.
+func (l *LRU[T]) Size() int {
+	return l.order.Len()
+}
@@ -1,24 +1,25 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
-	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
-
 	"github.com/gomodule/redigo/redis"
+	"github.com/ipfs/go-cid"
 	"github.com/korovkin/limiter"
 	rg "github.com/redislabs/redisgraph-go"
-	"github.com/trudi-group/ipfs-metric-exporter/metricplugin"
 )
 
 // routingKeyFmt is the format of the RabbitMQ routing key that we subscribe to (taken from metricplugin source code).
@@ -28,9 +29,15 @@ const routingKeyFmt = "monitor.%s.bitswap_messages"
 // See: https://github.com/trudi-group/ipfs-metric-exporter/blob/master/docker-compose/docker-compose.yml.
 const monitorHost = "docker_compose_monitor_01"
 
+// monitors are the names of the monitors whose Bitswap messages we subscribe to ("*" subscribes to all monitors).
+var monitors = []string{monitorHost}
+
 // dataDir is the path to the folder where IPFS data blocks should be exported to.
 const dataDir = "data"
 
+// eventsDir is the path to the folder where processed events are logged to.
+const eventsDir = "events"
+
 // rgHost is the host of the RedisGraph database.
 var rgHost = "127.0.0.1:6379"
 
@@ -40,7 +47,7 @@ var rmqURL = "amqp://127.0.0.1:5672/%2f"
 // graph is the database interface.
 var graph rg.Graph
 
-// jobs carries the asynchronous tasks of DownloadRawFile.
+// jobs carries the asynchronous disk writes of block data.
 var jobs *limiter.ConcurrencyLimiter
 
 // ipfsTimeout defines the timeout for CID requests to IPFS.
@@ -57,16 +64,94 @@ func init() {
 	if rmqURLEnv != "" {
 		rmqURL = rmqURLEnv
 	}
+	monitorsEnv := os.Getenv("MONITORS")
+	if monitorsEnv != "" {
+		monitors = strings.Split(monitorsEnv, ",")
+	}
 }
 
 func main() {
 	// init flags
-	maxConcurrentDownloads := flag.Int("climit", 10, "limit of concurrent download jobs")
+	maxConcurrentDownloads := flag.Int("climit", 10, "limit of concurrent disk writes of block data")
+	traversalWorkers := flag.Int("traversal-workers", 4, "Number of blocks of a requested DAG that are expanded concurrently")
+	networkLimit := flag.Int("network-limit", 16, "Limit of concurrent block retrievals from IPFS")
+	maxDepth := flag.Int("max-depth", 0, "Maximum depth of the DAG below a requested CID that is traversed (0 = unlimited)")
+	maxBlocks := flag.Int("max-blocks", 0, "Maximum number of blocks retrieved per requested CID (0 = unlimited)")
+	maxBytes := flag.Int64("max-bytes", 0, "Maximum MB of block data retrieved per requested CID (0 = unlimited)")
+	maxDuration := flag.Int("max-duration", 0, "Maximum time in seconds spent on the traversal of a requested CID (0 = unlimited)")
+	resume := flag.Bool("resume", true, "If set, traversals that were interrupted in a previous run are finished at startup")
+	retryAttempts := flag.Int("retry-attempts", 5, "Maximum number of attempts to retrieve a block (1 = no retries)")
+	retryDelay := flag.Int("retry-delay", 60, "Delay in seconds before the first retry of a failed block, doubling with every attempt")
+	retryMaxDelay := flag.Int("retry-max-delay", 6*60*60, "Maximum delay in seconds between retries of a failed block")
+	graphConns := flag.Int("graph-conns", 4, "Number of connections to RedisGraph, which limits concurrent graph writes")
 	ipfsTimeoutArg := flag.Int("timeout", 10, "Timeout in seconds when retrieving a block from IPFS")
 	logOutput := flag.Bool("log-output", false, "If set, info/debug logs on the progress are written to a file")
-	logEvents := flag.Bool("log-events", false, "If set, processing events are exported to a JSON file")
+	logEvents := flag.Bool("log-events", false, "If set, processing events are exported to a rotating JSON lines log")
+	eventsMaxSize := flag.Int64("events-max-size", 100, "Size in MB after which the event log is rotated")
+	eventsMaxAge := flag.Int("events-max-age", 60, "Age in minutes after which the event log is rotated")
+	eventsCompression := flag.String("events-compression", "gzip", "Compression of rotated event log segments: gzip, zstd or none")
+	flattenDir := flag.String("flatten-dir", "", "If set, wantlist entries are additionally exported as hourly partitioned CSV files to this directory")
+	sourceName := flag.String("source", "rabbitmq", "Source of Bitswap events: rabbitmq, stdin or http")
+	httpAddr := flag.String("http-addr", ":8080", "Listen address when events are pushed via HTTP")
+	httpMaxBody := flag.Int64("http-max-body", 32, "Size limit in MB of a batch pushed via HTTP")
+	rmqQueue := flag.String("queue", "ipfs-replicate", "Name prefix of the durable RabbitMQ queue to consume from (suffixed with a hash of the routing keys)")
+	rmqPrefetch := flag.Int("prefetch", 10, "Maximum number of unacknowledged RabbitMQ messages")
+	filterPath := flag.String("filter", "", "Path to a JSON file with rules that select which requested CIDs are fetched")
+	fetchWorkers := flag.Int("fetch-workers", 1, "Number of requested CIDs that are fetched concurrently")
+	recencyDecay := flag.Int("recency-decay", 300, "Time constant in seconds (> 0) with which the recency of requests decays when ranking pending CIDs")
+	queueSize := flag.Int("queue-size", 100000, "Maximum number of requested CIDs waiting to be fetched (0 = unbounded)")
+	queueOverflow := flag.String("queue-overflow", OverflowBlock, "What to do when the fetch queue is full: block, or drop requests with drop-oldest, drop-newest or sample")
+	dedupSize := flag.Int("dedup-size", 100000, "Number of recently scheduled CIDs that are not downloaded again (0 = disabled)")
+	dedupFlush := flag.Int("dedup-flush", 10, "Interval in seconds in which request counters are written to the graph")
+	statsWindow := flag.Int("stats-window", 300, "Size in seconds of the time windows in which want statistics are aggregated (0 = disabled)")
+	statsTop := flag.Int("stats-top", 100, "Number of most requested CIDs that are stored per statistics window")
+	statsRetention := flag.Int("stats-retention", 0, "Hours after which stored statistics windows expire (0 = never)")
+	debugAddr := flag.String("debug-addr", "", "If set, counters (/debug/vars) and profiles (/debug/pprof) are served on this address")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [flags] [command]\n\nCommands:\n", os.Args[0])
+		fmt.Fprintln(out, "  replay [-speed factor] [-from time] [-to time] <event log>...")
+		fmt.Fprintln(out, "                                         process recorded event logs instead of live events")
+		fmt.Fprintln(out, "  flatten [-from time] [-to time] <dest> <event log>...")
+		fmt.Fprintln(out, "                                         export recorded event logs as partitioned CSV files")
+		fmt.Fprintln(out, "  export <cid> <dest>                    rebuild a replicated file or directory tree")
+		fmt.Fprintln(out, "  verify                                 check the blocks in the data folder against their CIDs")
+		fmt.Fprintln(out, "  quarantine list                        list quarantined malformed batches")
+		fmt.Fprintln(out, "  quarantine reinject                    process quarantined batches that can be decoded by now")
+		fmt.Fprintln(out, "\nFlags:")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	if flag.Arg(0) == "quarantine" && flag.Arg(1) == "list" {
+		if err := printQuarantine(os.Stdout, &Quarantine{Dir: quarantineDir}); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "flatten" {
+		flattenEventLogs(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "verify" {
+		verifyData()
+		return
+	}
+
+	var filter *EventFilter
+	if *filterPath != "" {
+		var err error
+		if filter, err = LoadEventFilter(*filterPath); err != nil {
+			log.Fatalf("error loading filter rules: %v", err)
+		}
+	}
+
+	if *debugAddr != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*debugAddr, nil))
+		}()
+	}
+
 	ipfsTimeout = time.Second * time.Duration(*ipfsTimeoutArg)
 
 	var cancel context.CancelFunc
@@ -88,17 +173,31 @@ func main() {
 	}
 	defer logF.Close()
 
-	var eventsLogFile *os.File
+	var eventLog *EventLogWriter
 	if *logEvents {
 		var err error
-		eventsLogFile, err = os.OpenFile(
-			fmt.Sprintf("events/%s.json", time.Now().Format("20060201150405")),
-			os.O_APPEND|os.O_CREATE|os.O_WRONLY,
-			0644,
+		eventLog, err = NewEventLogWriter(
+			eventsDir,
+			*eventsMaxSize<<20,
+			time.Minute*time.Duration(*eventsMaxAge),
+			*eventsCompression,
 		)
 		if err != nil {
-			log.Fatalf("error creating event log file: %v", err)
+			log.Fatalf("error creating event log: %v", err)
 		}
+		defer eventLog.Close()
+	}
+	var sinks []EventSink
+	var closers []io.Closer
+	if eventLog != nil {
+		sinks = append(sinks, eventLog)
+		closers = append(closers, eventLog)
+	}
+	if *flattenDir != "" {
+		exporter := NewCSVExporter(*flattenDir)
+		defer exporter.Close()
+		sinks = append(sinks, exporter)
+		closers = append(closers, exporter)
 	}
 
 	// connect to redis graph
@@ -109,6 +208,49 @@ func main() {
 	}
 	defer conn.Close()
 	graph = rg.GraphNew("ipfs", conn)
+	if flag.Arg(0) == "export" {
+		exportContent(&graph, flag.Args()[1:])
+		return
+	}
+	graphs := []GraphQuerier{&graph}
+	for i := 1; i < *graphConns; i++ {
+		conn, err := redis.Dial("tcp", rgHost)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+		g := rg.GraphNew("ipfs", conn)
+		graphs = append(graphs, &g)
+	}
+	graphPool := NewGraphPool(graphs...)
+
+	if *statsWindow > 0 {
+		// the graph connections are shared by the fetch workers, hence statistics get their own connection
+		statsConn, err := redis.Dial("tcp", rgHost)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer statsConn.Close()
+		aggregator := NewStatsAggregator(
+			statsConn,
+			time.Second*time.Duration(*statsWindow),
+			*statsTop,
+			time.Hour*time.Duration(*statsRetention),
+		)
+		defer func() {
+			if err := aggregator.Close(); err != nil {
+				log.Println(err)
+			}
+		}()
+		sinks = append(sinks, aggregator)
+		closers = append(closers, aggregator)
+	}
+	var dedup *RequestDeduplicator
+	if *dedupSize > 0 {
+		dedup = NewRequestDeduplicator(graphPool, *dedupSize, time.Second*time.Duration(*dedupFlush))
+		closers = append(closers, dedup)
+	}
+	go closeOnSignal(closers...)
 
 	// connect to ipfs
 	log.Println("Connecting to IPFS... ")
@@ -116,90 +258,237 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	fetcher := NewIPFSFetcher(ctx, node, &graph, dataDir)
-
+	// disk writes of the fetcher (including retries and resumed traversals) go through jobs
 	jobs = limiter.NewConcurrencyLimiter(*maxConcurrentDownloads)
-
-	// connect to and setup rabbitmq
-	log.Println("Connecting to RabbitMQ... ")
-	rmq, err := amqp.Dial(rmqURL)
-	if err != nil {
-		log.Fatal(err)
+	fetcher := NewIPFSFetcher(ctx, node, graphPool, dataDir, FetchLimits{
+		Workers: *traversalWorkers,
+		Network: *networkLimit,
+		Budget: Budget{
+			MaxDepth:    *maxDepth,
+			MaxBlocks:   *maxBlocks,
+			MaxBytes:    *maxBytes << 20,
+			MaxDuration: time.Second * time.Duration(*maxDuration),
+		},
+	})
+	// retries are stopped before jobs is closed, since a retry traversal schedules disk writes
+	retryCtx, stopRetries := context.WithCancel(ctx)
+	defer stopRetries()
+	var retrying sync.WaitGroup
+	if *retryAttempts > 1 {
+		retryConn, err := redis.Dial("tcp", rgHost)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer retryConn.Close()
+		fetcher.Retries = NewRetryQueue(
+			retryConn,
+			time.Second*time.Duration(*retryDelay),
+			time.Second*time.Duration(*retryMaxDelay),
+			*retryAttempts,
+		)
+		retrying.Add(1)
+		go func() {
+			defer retrying.Done()
+			fetcher.Retries.Run(retryCtx, fetcher, 10*time.Second)
+		}()
 	}
-	defer rmq.Close()
-
-	ch, err := rmq.Channel()
+	fetcher.Dedup = dedup
+	scheduler, err := NewFetchScheduler(time.Second*time.Duration(*recencyDecay), *queueSize, *queueOverflow)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer ch.Close()
-
-	if err := ch.ExchangeDeclare(
-		metricplugin.ExchangeName, "topic", false, false, false, false, nil,
-	); err != nil {
-		log.Fatal(err)
+	expvar.Publish("fetch_queue", expvar.Func(scheduler.Stats))
+	go scheduler.ReportStats(time.Minute)
+
+	processor := NewProcessor(
+		fetcher,
+		NewEventRecorder(graphPool),
+		scheduler,
+		*fetchWorkers,
+		filter,
+		dedup,
+		sinks...,
+	)
+
+	// select the source of Bitswap events
+	var source EventSource
+	switch {
+	case flag.Arg(0) == "replay":
+		replayFlags := flag.NewFlagSet("replay", flag.ExitOnError)
+		speed := replayFlags.Float64("speed", 1, "Replay speed relative to the recorded timestamps (0 = as fast as possible)")
+		from, to := timeRangeFlags(replayFlags)
+		replayFlags.Parse(flag.Args()[1:])
+		if replayFlags.NArg() == 0 {
+			log.Fatal("replay requires at least one event log file or directory")
+		}
+		source = newFileSource(replayFlags.Args(), *speed, *from, *to)
+	case flag.Arg(0) == "quarantine" && flag.Arg(1) == "reinject":
+		quarantine = NewQuarantine(quarantineDir)
+		source = quarantine
+	case flag.NArg() > 0:
+		flag.Usage()
+		os.Exit(2)
+	case *sourceName == "rabbitmq":
+		log.Println("Connecting to RabbitMQ... ")
+		routingKeys := make([]string, len(monitors))
+		for i, monitor := range monitors {
+			routingKeys[i] = fmt.Sprintf(routingKeyFmt, strings.TrimSpace(monitor))
+		}
+		source = &RabbitMQSource{URL: rmqURL, Queue: *rmqQueue, Prefetch: *rmqPrefetch, RoutingKeys: routingKeys}
+	case *sourceName == "stdin":
+		source = NewReaderSource("stdin", os.Stdin)
+	case *sourceName == "http":
+		source = &HTTPSource{Addr: *httpAddr, MaxBodySize: *httpMaxBody << 20}
+	default:
+		log.Fatalf("unknown event source: %s", *sourceName)
+	}
+	// the quarantine folder is only created by commands that consume events
+	if quarantine == nil {
+		quarantine = NewQuarantine(quarantineDir)
 	}
 
-	q, err := ch.QueueDeclare("", false, false, true, false, nil)
-	if err != nil {
-		log.Fatal(err)
+	batches := make(chan Batch)
+	go func() {
+		defer close(batches)
+		if err := source.Stream(ctx, batches); err != nil {
+			log.Fatalf("error reading events: %v", err)
+		}
+	}()
+
+	// finish the traversals that were interrupted in a previous run alongside the new requests
+	var resumed sync.WaitGroup
+	if *resume {
+		resumed.Add(1)
+		go func() {
+			defer resumed.Done()
+			fetcher.Resume()
+		}()
 	}
 
-	if err := ch.QueueBind(
-		q.Name,
-		fmt.Sprintf(routingKeyFmt, monitorHost),
-		metricplugin.ExchangeName,
-		false,
-		nil,
-	); err != nil {
+	log.Printf("Waiting for messages...")
+	processor.ProcessMessages(batches)
+	resumed.Wait()
+	stopRetries()
+	retrying.Wait()
+
+	if err := jobs.WaitAndClose(); err != nil {
 		log.Fatal(err)
 	}
+	log.Println("Event source exhausted.")
+}
 
-	msgs, err := ch.Consume(q.Name, "", true, false, false, false, nil)
+// exportContent rebuilds a replicated file or directory tree and reports the blocks missing in the replica.
+func exportContent(graph GraphQuerier, args []string) {
+	if len(args) != 2 {
+		log.Fatal("export requires a CID and a destination path")
+	}
+	root, err := cid.Parse(args[0])
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("invalid CID %s: %v", args[0], err)
 	}
 
-	log.Printf("Waiting for messages...")
-	go processMessages(fetcher, msgs, eventsLogFile)
+	exporter := NewExporter(graph, dataDir)
+	if err := exporter.Export(root, args[1]); err != nil {
+		log.Fatalf("error exporting %s: %v", root, err)
+	}
+	if len(exporter.Missing) > 0 {
+		for _, missing := range exporter.Missing {
+			fmt.Printf("missing block %s of %s\n", missing.Cid, missing.Path)
+		}
+		log.Fatalf("Export of %s is incomplete: %d blocks missing.", root, len(exporter.Missing))
+	}
+	log.Printf("Exported %s to %s.", root, args[1])
+}
 
-	var forever chan struct{}
-	<-forever
+// closeOnSignal closes the given sinks and exits once the process is interrupted or terminated, such that the
+// open event log segment and export partitions are complete on disk, the open statistics windows are stored and
+// pending request counts are written to the graph.
+func closeOnSignal(closers ...io.Closer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %s, closing event sinks...", sig)
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	os.Exit(1)
+}
 
-	if err := jobs.WaitAndClose(); err != nil {
-		log.Fatal(err)
+// verifyData checks the blocks in the data folder against their CIDs and exits with an error if any is corrupt.
+// Blocks that cannot be verified are listed, but do not fail the check.
+func verifyData() {
+	verified, skipped, unverifiable, corrupt, err := verifyDataDir(dataDir)
+	if err != nil {
+		log.Fatalf("error verifying data folder: %v", err)
+	}
+	for _, block := range unverifiable {
+		fmt.Printf("unverifiable block %s: %v\n", block.Cid, block.Err)
+	}
+	for _, block := range corrupt {
+		fmt.Printf("corrupt block %s: %v\n", block.Cid, block.Err)
+	}
+	log.Printf("Verified %d blocks (%d skipped, %d unverifiable).", verified, skipped, len(unverifiable))
+	if len(corrupt) > 0 {
+		log.Fatalf("%d corrupt blocks found.", len(corrupt))
 	}
 }
 
-// processMessages processes incoming sets of Bitswap messages.
-func processMessages(f *IPFSFetcher, msgs <-chan amqp.Delivery, eventsLogFile *os.File) {
-	for d := range msgs {
-		r, err := gzip.NewReader(bytes.NewReader(d.Body))
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer r.Close()
+// flattenEventLogs exports recorded event logs as partitioned CSV files (see CSVExporter).
+func flattenEventLogs(args []string) {
+	flattenFlags := flag.NewFlagSet("flatten", flag.ExitOnError)
+	from, to := timeRangeFlags(flattenFlags)
+	flattenFlags.Parse(args)
+	if flattenFlags.NArg() < 2 {
+		log.Fatal("flatten requires a destination directory and at least one event log file or directory")
+	}
 
-		data, err := io.ReadAll(r)
-		if err != nil {
-			log.Fatal(err)
+	exporter := NewCSVExporter(flattenFlags.Arg(0))
+	source := newFileSource(flattenFlags.Args()[1:], 0, *from, *to)
+	batches := make(chan Batch)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(batches)
+		errc <- source.Stream(context.Background(), batches)
+	}()
+	for batch := range batches {
+		if err := exporter.Write(batch.Events); err != nil {
+			log.Fatalf("error exporting events: %v", err)
 		}
+	}
+	if err := <-errc; err != nil {
+		log.Fatalf("error reading events: %v", err)
+	}
+	if err := exporter.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
 
-		var events []Event
-		if err := json.Unmarshal(data, &events); err != nil {
-			panic(err)
-		}
+// timeRangeFlags defines the -from and -to flags of commands that read event logs.
+func timeRangeFlags(flags *flag.FlagSet) (from, to *string) {
+	from = flags.String("from", "", "Only read events at or after this time (RFC 3339)")
+	to = flags.String("to", "", "Only read events at or before this time (RFC 3339)")
+	return from, to
+}
 
-		if eventsLogFile != nil {
-			if _, err := eventsLogFile.Write(append(data, []byte("\n")...)); err != nil {
-				log.Fatalf("error logging event: %v", err)
-			}
-		}
+// newFileSource creates a FileSource for the given paths, speed and optional time range.
+func newFileSource(paths []string, speed float64, from, to string) *FileSource {
+	source := &FileSource{Paths: paths, Speed: speed}
+	var err error
+	if source.From, err = parseOptionalTime(from); err != nil {
+		log.Fatal(err)
+	}
+	if source.To, err = parseOptionalTime(to); err != nil {
+		log.Fatal(err)
+	}
+	return source
+}
 
-		for _, ev := range events {
-			for _, block := range ev.BitswapMessage.WantlistEntries {
-				f.Download(block.Cid, 0, nil)
-			}
-		}
+// parseOptionalTime parses an RFC 3339 time, or returns the zero time for an empty string.
+func parseOptionalTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
 	}
+	return time.Parse(time.RFC3339, s)
 }
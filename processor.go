@@ -0,0 +1,150 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	"github.com/ipfs/go-cid"
+)
+
+// EventSink receives every batch of events that is processed, e.g. to log or export it.
+type EventSink interface {
+	Write(events []Event) error
+}
+
+// Processor drives incoming Bitswap events through the replication pipeline. Requested CIDs are queued in a
+// FetchScheduler, from which a number of workers fetch them independently of the ingestion of events.
+type Processor struct {
+	fetcher   *IPFSFetcher
+	recorder  *EventRecorder
+	scheduler *FetchScheduler
+	workers   int
+	// filter decides which requested CIDs are fetched (nil fetches all).
+	filter *EventFilter
+	// dedup skips recently scheduled CIDs and counts requests (nil disables deduplication).
+	dedup *RequestDeduplicator
+	// sinks receive every processed batch of events.
+	sinks []EventSink
+}
+
+// NewProcessor creates a Processor.
+func NewProcessor(
+	f *IPFSFetcher,
+	r *EventRecorder,
+	scheduler *FetchScheduler,
+	workers int,
+	filter *EventFilter,
+	dedup *RequestDeduplicator,
+	sinks ...EventSink,
+) *Processor {
+	return &Processor{
+		fetcher:   f,
+		recorder:  r,
+		scheduler: scheduler,
+		workers:   workers,
+		filter:    filter,
+		dedup:     dedup,
+		sinks:     sinks,
+	}
+}
+
+// ProcessMessages processes incoming sets of Bitswap messages. It returns once batches is closed and all
+// scheduled CIDs have been fetched.
+func (p *Processor) ProcessMessages(batches <-chan Batch) {
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.fetchRoots()
+		}()
+	}
+
+	for batch := range batches {
+		for _, sink := range p.sinks {
+			if err := sink.Write(batch.Events); err != nil {
+				log.Fatalf("error exporting events: %v", err)
+			}
+		}
+
+		p.processEvents(batch.Events)
+		if p.dedup != nil {
+			if err := p.dedup.MaybeFlush(); err != nil {
+				log.Fatalf("failed to update request counters: %v", err)
+			}
+		}
+
+		if batch.Ack != nil {
+			if err := batch.Ack(); err != nil {
+				log.Printf("error acknowledging batch: %v", err)
+			}
+		}
+	}
+
+	p.scheduler.Close()
+	wg.Wait()
+
+	if p.dedup != nil {
+		if err := p.dedup.Flush(); err != nil {
+			log.Fatalf("failed to update request counters: %v", err)
+		}
+	}
+}
+
+// processEvents records a set of Bitswap events in the graph and schedules the CIDs they request for fetching.
+// Scheduled CIDs are marked as pending in the graph first, so that they are resumed after a restart even though
+// the batch is acknowledged before they are fetched.
+func (p *Processor) processEvents(events []Event) {
+	type scheduled struct {
+		ev    Event
+		entry bsmsg.Entry
+	}
+	var roots []scheduled
+	for _, ev := range events {
+		if err := p.recorder.Record(ev); err != nil {
+			log.Fatalf("failed to record event of peer %s: %v", ev.Peer, err)
+		}
+		for _, entry := range ev.BitswapMessage.WantlistEntries {
+			if !p.filter.Allow(ev, entry) {
+				continue
+			}
+			if entry.Cancel {
+				// cancels are recorded, but neither fetch nor rank a CID
+				continue
+			}
+			if p.dedup != nil && !p.dedup.Schedule(entry.Cid) {
+				// repeat requests for a root that is still pending raise its rank
+				p.scheduler.Touch(ev, entry)
+				continue
+			}
+			roots = append(roots, scheduled{ev, entry})
+		}
+	}
+	if len(roots) == 0 {
+		return
+	}
+
+	cids := make([]cid.Cid, len(roots))
+	for i, root := range roots {
+		cids[i] = root.entry.Cid
+	}
+	p.fetcher.markPending(cids)
+	for _, root := range roots {
+		// dropped roots stay pending in the graph, and further requests for them are passed on again
+		if dropped := p.scheduler.Push(root.ev, root.entry); dropped.Defined() && p.dedup != nil {
+			p.dedup.Forget(dropped)
+		}
+	}
+}
+
+// fetchRoots downloads the highest ranked pending CIDs until the scheduler is closed and drained.
+func (p *Processor) fetchRoots() {
+	for {
+		root, ok := p.scheduler.Pop()
+		if !ok {
+			return
+		}
+		p.fetcher.Download(root.Cid, root.Monitor)
+	}
+}
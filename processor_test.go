@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	"github.com/ipfs/go-cid"
+	"github.com/korovkin/limiter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessor_ProcessMessages(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (n) DETACH DELETE n")
+
+	fetcher := NewIPFSFetcher(context.Background(), NewMockIPFSNode(), graphPoolTest, ipfsTestDataPath, FetchLimits{Workers: 2, Network: 2})
+	scheduler, err := NewFetchScheduler(time.Minute, 10, OverflowBlock)
+	assert.Nil(t, err)
+	processor := NewProcessor(fetcher, NewEventRecorder(graphPoolTest), scheduler, 1, nil, nil)
+
+	// the event is recorded, creating the block, before the requested CID is fetched
+	var want bsmsg.Entry
+	want.Cid = cid.MustParse(fileCID)
+	batches := make(chan Batch, 1)
+	batches <- Batch{Events: []Event{{
+		Timestamp:      time.Now(),
+		Peer:           "12D3KooWPeer",
+		BitswapMessage: BitswapMessage{WantlistEntries: []bsmsg.Entry{want}},
+	}}}
+	close(batches)
+
+	jobs = limiter.NewConcurrencyLimiter(1)
+	processor.ProcessMessages(batches)
+	jobs.WaitAndClose()
+
+	res, err := graphTest.Query(fmt.Sprintf(
+		"MATCH (:Peer)-[:requested]->(b:Block { cid: '%s' }) RETURN b.state, b.type", fileCID,
+	))
+	assert.Nil(t, err)
+	assert.True(t, res.Next())
+	assert.Equal(t, []interface{}{StateComplete, "File"}, res.Record().Values())
+	for _, c := range []string{rawCID, otherRawCID} {
+		_, err := os.Stat(filepath.Join(ipfsTestDataPath, c))
+		assert.Nil(t, err, c)
+	}
+}
+
+func TestProcessor_MarkPending(t *testing.T) {
+	defer graphTest.Query("MATCH (n) DETACH DELETE n")
+
+	fetcher := NewIPFSFetcher(context.Background(), NewMockIPFSNode(), graphPoolTest, ipfsTestDataPath, FetchLimits{})
+	defer os.RemoveAll(ipfsTestDataPath)
+	scheduler, err := NewFetchScheduler(time.Minute, 10, OverflowBlock)
+	assert.Nil(t, err)
+	processor := NewProcessor(fetcher, NewEventRecorder(graphPoolTest), scheduler, 1, nil, nil)
+
+	var want bsmsg.Entry
+	want.Cid = cid.MustParse(fileCID)
+	processor.processEvents([]Event{{
+		Timestamp: time.Now(),
+		Peer:      "12D3KooWPeer",
+		BitswapMessage: BitswapMessage{
+			WantlistEntries: []bsmsg.Entry{want},
+			Blocks:          []cid.Cid{cid.MustParse(rawCID)},
+		},
+	}})
+
+	// the scheduled root survives a restart before it is fetched
+	assert.Equal(t, 1, scheduler.Len())
+	res, err := graphTest.Query("MATCH (b:Block) RETURN b.cid, b.state ORDER BY b.cid")
+	assert.Nil(t, err)
+	var states [][]interface{}
+	for res.Next() {
+		states = append(states, res.Record().Values())
+	}
+	assert.Equal(t, [][]interface{}{{rawCID, nil}, {fileCID, StatePending}}, states)
+}
+
+func TestProcessor_DedupRank(t *testing.T) {
+	defer graphTest.Query("MATCH (n) DETACH DELETE n")
+
+	fetcher := NewIPFSFetcher(context.Background(), NewMockIPFSNode(), graphPoolTest, ipfsTestDataPath, FetchLimits{})
+	defer os.RemoveAll(ipfsTestDataPath)
+	scheduler, err := NewFetchScheduler(time.Minute, 10, OverflowBlock)
+	assert.Nil(t, err)
+	dedup := NewRequestDeduplicator(graphPoolTest, 10, time.Hour)
+	processor := NewProcessor(fetcher, NewEventRecorder(graphPoolTest), scheduler, 1, nil, dedup)
+
+	now := time.Now()
+	request := func(peer string, c string, ts time.Time) Event {
+		return Event{
+			Timestamp:      ts,
+			Peer:           peer,
+			BitswapMessage: BitswapMessage{WantlistEntries: []bsmsg.Entry{wantEntry(c, 0, false)}},
+		}
+	}
+	processor.processEvents([]Event{request("a", fileCID, now), request("a", rawCID, now.Add(time.Second))})
+	// the request of a second peer is deduplicated, but still moves the older root ahead
+	processor.processEvents([]Event{request("b", fileCID, now.Add(time.Second))})
+
+	assert.Equal(t, 2, scheduler.Len())
+	root, ok := scheduler.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, fileCID, root.Cid.String())
+	assert.Equal(t, 2, root.Peers.Size())
+}
+
+func TestProcessor_DedupOverflow(t *testing.T) {
+	defer graphTest.Query("MATCH (n) DETACH DELETE n")
+
+	fetcher := NewIPFSFetcher(context.Background(), NewMockIPFSNode(), graphPoolTest, ipfsTestDataPath, FetchLimits{})
+	defer os.RemoveAll(ipfsTestDataPath)
+	scheduler, err := NewFetchScheduler(time.Minute, 1, OverflowDropOldest)
+	assert.Nil(t, err)
+	dedup := NewRequestDeduplicator(graphPoolTest, 10, time.Hour)
+	processor := NewProcessor(fetcher, NewEventRecorder(graphPoolTest), scheduler, 1, nil, dedup)
+
+	request := func(c string) []Event {
+		return []Event{{
+			Timestamp:      time.Now(),
+			Peer:           "12D3KooWPeer",
+			BitswapMessage: BitswapMessage{WantlistEntries: []bsmsg.Entry{wantEntry(c, 0, false)}},
+		}}
+	}
+	processor.processEvents(request(fileCID))
+	processor.processEvents(request(rawCID))
+	// the evicted root is not deduplicated, so it is queued again with its next request
+	processor.processEvents(request(fileCID))
+
+	root, ok := scheduler.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, fileCID, root.Cid.String())
+}
+
+func TestProcessor_Cancel(t *testing.T) {
+	defer graphTest.Query("MATCH (n) DETACH DELETE n")
+
+	fetcher := NewIPFSFetcher(context.Background(), NewMockIPFSNode(), graphPoolTest, ipfsTestDataPath, FetchLimits{})
+	defer os.RemoveAll(ipfsTestDataPath)
+	scheduler, err := NewFetchScheduler(time.Minute, 10, OverflowBlock)
+	assert.Nil(t, err)
+	dedup := NewRequestDeduplicator(graphPoolTest, 10, time.Hour)
+	processor := NewProcessor(fetcher, NewEventRecorder(graphPoolTest), scheduler, 1, nil, dedup)
+
+	processor.processEvents([]Event{{
+		Timestamp:      time.Now(),
+		Peer:           "12D3KooWPeer",
+		BitswapMessage: BitswapMessage{WantlistEntries: []bsmsg.Entry{wantEntry(fileCID, 0, true)}},
+	}})
+
+	assert.Equal(t, 0, scheduler.Len())
+	assert.Empty(t, dedup.counts)
+	res, err := graphTest.Query(fmt.Sprintf(
+		"MATCH (:Peer)-[:cancelled]->(b:Block { cid: '%s' }) RETURN b.state", fileCID,
+	))
+	assert.Nil(t, err)
+	assert.True(t, res.Next())
+	assert.Nil(t, res.Record().GetByIndex(0))
+}
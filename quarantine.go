@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// quarantineDir is the path to the folder where undecodable event batches are kept.
+const quarantineDir = "quarantine"
+
+// quarantine stores undecodable batches. If nil, sources fail on malformed input instead.
+var quarantine *Quarantine
+
+// quarantinedBatches counts the batches that have been put into quarantine.
+var quarantinedBatches = expvar.NewInt("quarantined_batches")
+
+// QuarantineEntry is a malformed batch along with the reason why it could not be decoded.
+type QuarantineEntry struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	// Monitor is the originating monitor if it is known apart from the payload, e.g. from the routing key.
+	Monitor string `json:"monitor,omitempty"`
+	// Encoding is the content encoding of Body ("gzip" or empty).
+	Encoding string `json:"encoding,omitempty"`
+	Error    string `json:"error"`
+	Body     []byte `json:"body"`
+}
+
+// Decode tries to decode the entry's body into a set of events once more.
+func (e *QuarantineEntry) Decode() ([]Event, error) {
+	events, err := decodePayload(e.Body, e.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	setMonitor(events, e.Monitor)
+	return events, nil
+}
+
+// Quarantine keeps malformed batches as JSON files in a directory so that they can be inspected and re-injected.
+type Quarantine struct {
+	Dir string
+	mu  sync.Mutex
+	seq int
+}
+
+// NewQuarantine creates a quarantine in dir.
+func NewQuarantine(dir string) *Quarantine {
+	if err := os.Mkdir(dir, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		log.Fatalf("error creating quarantine folder: %v", err)
+	}
+	return &Quarantine{Dir: dir}
+}
+
+// Put stores a malformed batch along with the decoding error.
+func (q *Quarantine) Put(entry QuarantineEntry, reason error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry.Time = time.Now()
+	entry.Error = reason.Error()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// names sort chronologically and are unique across runs, which restart the sequence
+	q.seq++
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	path := filepath.Join(q.Dir, fmt.Sprintf("%s-%06d-%x.json", entry.Time.Format("20060102150405.000000000"), q.seq, suffix))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	quarantinedBatches.Add(1)
+	log.Printf("Quarantined malformed batch from %s as %s: %v", entry.Source, path, reason)
+	return nil
+}
+
+// List returns the paths of all quarantined batches in chronological order.
+func (q *Quarantine) List() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(q.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Read loads the quarantined batch at path.
+func (q *Quarantine) Read(path string) (*QuarantineEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entry QuarantineEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Stream implements EventSource by re-injecting all quarantined batches that can be decoded by now.
+// A batch is removed from the quarantine once it has been acknowledged.
+func (q *Quarantine) Stream(ctx context.Context, out chan<- Batch) error {
+	paths, err := q.List()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		entry, err := q.Read(path)
+		if err != nil {
+			return err
+		}
+		events, err := entry.Decode()
+		if err != nil {
+			log.Printf("Batch %s still cannot be decoded: %v", path, err)
+			continue
+		}
+		path := path
+		if err := sendBatch(ctx, out, Batch{
+			Events: events,
+			Ack:    func() error { return os.Remove(path) },
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printQuarantine writes an overview of the quarantined batches to w.
+func printQuarantine(w io.Writer, q *Quarantine) error {
+	paths, err := q.List()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		entry, err := q.Read(path)
+		if err != nil {
+			return err
+		}
+		status := "still malformed"
+		if events, err := entry.Decode(); err == nil {
+			status = fmt.Sprintf("decodable (%d events)", len(events))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d bytes\t%s\t%s\n",
+			filepath.Base(path), entry.Time.Format(time.RFC3339), entry.Source, len(entry.Body), status, entry.Error)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuarantine(t *testing.T) {
+	q := NewQuarantine(t.TempDir())
+	before := quarantinedBatches.Value()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte(strings.Split(testEventLog, "\n")[0]))
+	gw.Close()
+
+	assert.Nil(t, q.Put(QuarantineEntry{Source: "rabbitmq", Monitor: "monitor_01", Encoding: "gzip", Body: buf.Bytes()}, errors.New("decoder bug")))
+	assert.Nil(t, q.Put(QuarantineEntry{Source: "stdin", Body: []byte("not json")}, errors.New("invalid character")))
+	assert.Equal(t, before+2, quarantinedBatches.Value())
+
+	t.Run("entries can be listed and read", func(t *testing.T) {
+		paths, err := q.List()
+		assert.Nil(t, err)
+		assert.Len(t, paths, 2)
+		entry, err := q.Read(paths[0])
+		assert.Nil(t, err)
+		assert.Equal(t, "rabbitmq", entry.Source)
+		assert.Equal(t, "decoder bug", entry.Error)
+	})
+
+	t.Run("entries of different runs do not overwrite each other", func(t *testing.T) {
+		other := NewQuarantine(q.Dir)
+		for i := 0; i < 10; i++ {
+			assert.Nil(t, other.Put(QuarantineEntry{Source: "stdin", Body: []byte("not json")}, errors.New("invalid character")))
+		}
+		paths, err := other.List()
+		assert.Nil(t, err)
+		assert.Len(t, paths, 12)
+		// the sequence is zero-padded, so the 10th entry sorts last
+		entry, err := other.Read(paths[0])
+		assert.Nil(t, err)
+		assert.Equal(t, "rabbitmq", entry.Source)
+		assert.Contains(t, filepath.Base(paths[11]), "-000010-")
+		for _, path := range paths[2:] {
+			assert.Nil(t, os.Remove(path))
+		}
+	})
+
+	t.Run("decodable entries are re-injected and removed on ack", func(t *testing.T) {
+		out := make(chan Batch, 2)
+		assert.Nil(t, q.Stream(context.Background(), out))
+		close(out)
+
+		var batches []Batch
+		for batch := range out {
+			batches = append(batches, batch)
+		}
+		assert.Len(t, batches, 1)
+		assert.Equal(t, "monitor_01", batches[0].Events[0].Monitor)
+		assert.Nil(t, batches[0].Ack())
+
+		paths, err := q.List()
+		assert.Nil(t, err)
+		assert.Len(t, paths, 1)
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	rg "github.com/redislabs/redisgraph-go"
+	"github.com/trudi-group/ipfs-metric-exporter/metricplugin"
+)
+
+// EventRecorder records the contents of Bitswap messages as relationships between peers and blocks in the graph:
+//
+//	(:Peer)-[:requested {ts, want_type, priority, send_dont_have, full_wantlist}]->(:Block)
+//	(:Peer)-[:cancelled {ts}]->(:Block)
+//	(:Peer)-[:sent {ts}]->(:Block)
+//	(:Peer)-[:have {ts}]->(:Block)
+//	(:Peer)-[:dont_have {ts}]->(:Block)
+//	(:Peer)-[:connected_via {first_seen, last_seen}]->(:Address {addr, ip_version, ip, transport, relay, asn})
+//
+// Every message creates new relationships, time-stamped (ts) in milliseconds since the epoch, such that the
+// sequence of retrievals of a peer can be queried directly.
+type EventRecorder struct {
+	graph GraphQuerier
+}
+
+// NewEventRecorder creates an EventRecorder writing to graph.
+func NewEventRecorder(graph GraphQuerier) *EventRecorder {
+	return &EventRecorder{graph: graph}
+}
+
+// Record writes the peer of an event and its relationships to all blocks referenced in the Bitswap message.
+func (r *EventRecorder) Record(ev Event) error {
+	msg := ev.BitswapMessage
+	q := &recordQuery{monitor: ev.Monitor, ts: int(ev.Timestamp.UnixMilli())}
+	q.clauses = append(q.clauses, fmt.Sprintf(
+		"MERGE (p:Peer {id: %s})%s", rg.ToString(ev.Peer), onCreateSetMonitor("p", ev.Monitor),
+	))
+
+	for _, entry := range msg.WantlistEntries {
+		if entry.Cancel {
+			q.relate(entry.Cid, "cancelled", nil)
+			continue
+		}
+		q.relate(entry.Cid, "requested", map[string]interface{}{
+			"want_type":      entry.WantType.String(),
+			"priority":       int(entry.Priority),
+			"send_dont_have": entry.SendDontHave,
+			"full_wantlist":  msg.FullWantList,
+		})
+	}
+	for _, block := range msg.Blocks {
+		q.relate(block, "sent", nil)
+	}
+	for _, presence := range msg.BlockPresences {
+		if presence.Type == metricplugin.Have {
+			q.relate(presence.Cid, "have", nil)
+		} else {
+			q.relate(presence.Cid, "dont_have", nil)
+		}
+	}
+
+	for _, addr := range msg.ConnectedAddresses {
+		pa, err := ParsePeerAddress(addr)
+		if err != nil {
+			log.Printf("Invalid address %s of peer %s: %v", addr, ev.Peer, err)
+			continue
+		}
+		q.connect(pa)
+	}
+
+	_, err := r.graph.Query(strings.Join(q.clauses, " "))
+	return err
+}
+
+// recordQuery builds a single query that creates all relationships of a message.
+type recordQuery struct {
+	monitor string
+	ts      int
+	clauses []string
+}
+
+// relate adds a time-stamped relationship of the given type and properties from the peer to the block.
+func (q *recordQuery) relate(_cid cid.Cid, relation string, props map[string]interface{}) {
+	if props == nil {
+		props = map[string]interface{}{}
+	}
+	props["ts"] = q.ts
+	if q.monitor != "" {
+		props["monitor"] = q.monitor
+	}
+
+	block := newNode(_cid)
+	block.Alias = fmt.Sprintf("b%d", len(q.clauses))
+	q.clauses = append(q.clauses,
+		"MERGE "+block.Encode()+onCreateSetMonitor(block.Alias, q.monitor),
+		fmt.Sprintf("CREATE (p)-[:%s %s]->(%s)", relation, encodeProperties(props), block.Alias),
+	)
+}
+
+// connect adds the address to the peer's addresses, keeping track of when it was first and last seen.
+func (q *recordQuery) connect(pa *PeerAddress) {
+	i := len(q.clauses)
+	q.clauses = append(q.clauses,
+		fmt.Sprintf("MERGE (a%d:Address %s)", i, encodeProperties(pa.Properties())),
+		fmt.Sprintf(
+			"MERGE (p)-[c%[1]d:connected_via]->(a%[1]d) ON CREATE SET c%[1]d.first_seen = %[2]d SET c%[1]d.last_seen = %[2]d",
+			i, q.ts,
+		),
+	)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/trudi-group/ipfs-metric-exporter/metricplugin"
+)
+
+func TestEventRecorder_Record(t *testing.T) {
+	defer graphTest.Query("MATCH (n) DETACH DELETE n")
+	recorder := NewEventRecorder(graphPoolTest)
+
+	ts := time.Date(2023, 1, 19, 10, 0, 0, 0, time.UTC)
+	var want, cancel bsmsg.Entry
+	want.Cid, want.WantType, want.Priority, want.SendDontHave = cid.MustParse(rawCID), pb.Message_Wantlist_Have, 5, true
+	cancel.Cid, cancel.Cancel = cid.MustParse(otherRawCID), true
+
+	err := recorder.Record(Event{
+		Timestamp: ts,
+		Peer:      "12D3KooWPeer",
+		Monitor:   "monitor_01",
+		BitswapMessage: BitswapMessage{
+			WantlistEntries: []bsmsg.Entry{want, cancel},
+			Blocks:          []cid.Cid{cid.MustParse(yetAnotherRawCID)},
+			BlockPresences: []metricplugin.BlockPresence{
+				{Cid: cid.MustParse(fileCID), Type: metricplugin.Have},
+				{Cid: cid.MustParse(directoryCID), Type: metricplugin.DontHave},
+			},
+			ConnectedAddresses: []string{"/ip4/147.75.80.110/tcp/4001"},
+		},
+	})
+	assert.Nil(t, err)
+
+	for relation, target := range map[string]string{
+		"requested": rawCID,
+		"cancelled": otherRawCID,
+		"sent":      yetAnotherRawCID,
+		"have":      fileCID,
+		"dont_have": directoryCID,
+	} {
+		t.Run(relation, func(t *testing.T) {
+			res, err := graphTest.Query(fmt.Sprintf(
+				"MATCH (p:Peer {id: '12D3KooWPeer'})-[r:%s]->(b:Block {cid: '%s'}) RETURN r.monitor, r.ts",
+				relation,
+				target,
+			))
+			assert.Nil(t, err)
+			assert.True(t, res.Next())
+			assert.Equal(t, []interface{}{"monitor_01", int(ts.UnixMilli())}, res.Record().Values())
+			assert.False(t, res.Next())
+		})
+	}
+
+	t.Run("request properties", func(t *testing.T) {
+		res, err := graphTest.Query("MATCH (:Peer)-[r:requested]->(:Block) RETURN r.want_type, r.priority, r.send_dont_have")
+		assert.Nil(t, err)
+		assert.True(t, res.Next())
+		assert.Equal(t, []interface{}{"Have", 5, true}, res.Record().Values())
+	})
+
+	t.Run("connected address", func(t *testing.T) {
+		res, err := graphTest.Query("MATCH (:Peer {id: '12D3KooWPeer'})-[c:connected_via]->(a:Address) RETURN a.ip, a.transport, c.first_seen")
+		assert.Nil(t, err)
+		assert.True(t, res.Next())
+		assert.Equal(t, []interface{}{"147.75.80.110", "tcp", int(ts.UnixMilli())}, res.Record().Values())
+		assert.False(t, res.Next())
+	})
+
+	t.Run("repeated requests are recorded individually", func(t *testing.T) {
+		assert.Nil(t, recorder.Record(Event{
+			Timestamp:      ts.Add(time.Second),
+			Peer:           "12D3KooWPeer",
+			BitswapMessage: BitswapMessage{WantlistEntries: []bsmsg.Entry{want}},
+		}))
+		res, err := graphTest.Query(fmt.Sprintf(
+			"MATCH (:Peer {id: '12D3KooWPeer'})-[r:requested]->(:Block {cid: '%s'}) RETURN r.ts ORDER BY r.ts",
+			rawCID,
+		))
+		assert.Nil(t, err)
+		assert.True(t, res.Next())
+		assert.Equal(t, int(ts.UnixMilli()), res.Record().GetByIndex(0))
+		assert.True(t, res.Next())
+		assert.Equal(t, int(ts.Add(time.Second).UnixMilli()), res.Record().GetByIndex(0))
+		assert.False(t, res.Next())
+	})
+}
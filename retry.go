@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/ipfs/go-cid"
+)
+
+// retryQueueKey is the Redis key of the sorted set of CIDs to retry, scored by the time of their next attempt.
+const retryQueueKey = "retry:queue"
+
+// retryLease is the time that a due block is held back in the queue while it is retried. If the process stops
+// before the retry finished, the block is due again once its lease expires.
+const retryLease = 30 * time.Minute
+
+// RetryQueue is a persistent queue of blocks whose retrieval failed. Blocks are retried with exponential backoff
+// until they were attempted maxAttempts times. Since the queue lives in Redis, pending retries survive restarts.
+type RetryQueue struct {
+	mu          sync.Mutex
+	conn        redis.Conn
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	maxAttempts int
+	// leased are the blocks returned by Due whose retry has not finished.
+	leased *Set[string]
+}
+
+// NewRetryQueue creates a RetryQueue whose delay starts at baseDelay and doubles with every attempt up to maxDelay.
+func NewRetryQueue(conn redis.Conn, baseDelay, maxDelay time.Duration, maxAttempts int) *RetryQueue {
+	return &RetryQueue{
+		conn:        conn,
+		baseDelay:   baseDelay,
+		maxDelay:    maxDelay,
+		maxAttempts: maxAttempts,
+		leased:      NewSet[string](),
+	}
+}
+
+// delay returns the backoff before the next attempt after the given number of failed attempts.
+func (q *RetryQueue) delay(attempts int) time.Duration {
+	d := float64(q.baseDelay) * math.Pow(2, float64(attempts-1))
+	if d > float64(q.maxDelay) {
+		return q.maxDelay
+	}
+	return time.Duration(d)
+}
+
+// Schedule queues a block for another attempt after it failed attempts times. It reports false if the block
+// has reached the maximum number of attempts.
+func (q *RetryQueue) Schedule(_cid cid.Cid, attempts int) (bool, error) {
+	if attempts >= q.maxAttempts {
+		return false, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	next := time.Now().Add(q.delay(attempts))
+	_, err := q.conn.Do("ZADD", retryQueueKey, next.Unix(), _cid.String())
+	// a block that failed during its retry is rescheduled rather than released by Done
+	q.leased.Delete(_cid.String())
+	return err == nil, err
+}
+
+// Due returns the blocks whose next attempt is due at the given time. The blocks stay in the queue with a lease
+// until their retry is acknowledged with Done.
+func (q *RetryQueue) Due(now time.Time) ([]cid.Cid, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	members, err := redis.Strings(q.conn.Do("ZRANGEBYSCORE", retryQueueKey, "-inf", now.Unix()))
+	if err != nil || len(members) == 0 {
+		return nil, err
+	}
+	lease := now.Add(retryLease).Unix()
+	args := redis.Args{retryQueueKey, "XX"}
+	for _, m := range members {
+		args = args.Add(lease, m)
+	}
+	if _, err := q.conn.Do("ZADD", args...); err != nil {
+		return nil, err
+	}
+	due := make([]cid.Cid, 0, len(members))
+	for _, m := range members {
+		q.leased.Add(m)
+		if c, err := cid.Parse(m); err == nil {
+			due = append(due, c)
+		}
+	}
+	return due, nil
+}
+
+// Done removes blocks returned by Due from the queue once their retry finished, unless they were rescheduled.
+func (q *RetryQueue) Done(cids ...cid.Cid) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	args := redis.Args{retryQueueKey}
+	for _, c := range cids {
+		if q.leased.Has(c.String()) {
+			args = args.Add(c.String())
+			q.leased.Delete(c.String())
+		}
+	}
+	if len(args) == 1 {
+		return nil
+	}
+	_, err := q.conn.Do("ZREM", args...)
+	return err
+}
+
+// Len returns the number of blocks waiting to be retried.
+func (q *RetryQueue) Len() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return redis.Int(q.conn.Do("ZCARD", retryQueueKey))
+}
+
+// Run retries due blocks with the fetcher, checking every interval until ctx is done. The blocks that are due at
+// once are traversed by one pool of workers.
+func (q *RetryQueue) Run(ctx context.Context, f *IPFSFetcher, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		due, err := q.Due(time.Now())
+		if err != nil {
+			log.Printf("error reading retry queue: %v", err)
+			continue
+		}
+		if len(due) == 0 {
+			continue
+		}
+		f.Retry(due...)
+		if err := q.Done(due...); err != nil {
+			log.Printf("error updating retry queue: %v", err)
+		}
+	}
+}
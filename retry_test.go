@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryQueue_Delay(t *testing.T) {
+	q := NewRetryQueue(nil, time.Minute, time.Hour, 10)
+	assert.Equal(t, time.Minute, q.delay(1))
+	assert.Equal(t, 2*time.Minute, q.delay(2))
+	assert.Equal(t, 32*time.Minute, q.delay(6))
+	assert.Equal(t, time.Hour, q.delay(7))
+}
+
+func TestRetryQueue_Due(t *testing.T) {
+	conn := graphTest.Conn
+	defer conn.Do("DEL", retryQueueKey)
+	q := NewRetryQueue(conn, time.Minute, time.Hour, 3)
+
+	ok, err := q.Schedule(cid.MustParse(rawCID), 1)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = q.Schedule(cid.MustParse(fileCID), 2)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = q.Schedule(cid.MustParse(otherRawCID), 3)
+	assert.Nil(t, err)
+	assert.False(t, ok, "maximum number of attempts reached")
+
+	due, err := q.Due(time.Now())
+	assert.Nil(t, err)
+	assert.Empty(t, due)
+
+	due, err = q.Due(time.Now().Add(90 * time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, []cid.Cid{cid.MustParse(rawCID)}, due)
+
+	due, err = q.Due(time.Now().Add(90 * time.Second))
+	assert.Nil(t, err)
+	assert.Empty(t, due, "leased until the retry is done")
+
+	n, err := q.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	assert.Nil(t, q.Done(cid.MustParse(rawCID)))
+	n, err = q.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	t.Run("rescheduled blocks are kept", func(t *testing.T) {
+		due, err := q.Due(time.Now().Add(3 * time.Minute))
+		assert.Nil(t, err)
+		assert.Equal(t, []cid.Cid{cid.MustParse(fileCID)}, due)
+		ok, err := q.Schedule(cid.MustParse(fileCID), 2)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Nil(t, q.Done(due...))
+		n, err := q.Len()
+		assert.Nil(t, err)
+		assert.Equal(t, 1, n)
+	})
+
+	t.Run("expired leases are due again", func(t *testing.T) {
+		due, err := q.Due(time.Now().Add(time.Hour))
+		assert.Nil(t, err)
+		assert.Equal(t, []cid.Cid{cid.MustParse(fileCID)}, due)
+		due, err = q.Due(time.Now().Add(time.Hour + retryLease))
+		assert.Nil(t, err)
+		assert.Equal(t, []cid.Cid{cid.MustParse(fileCID)}, due)
+	})
+}
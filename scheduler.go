@@ -0,0 +1,307 @@
+package main
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	"github.com/ipfs/go-cid"
+)
+
+// Overflow policies of the FetchScheduler.
+const (
+	// OverflowBlock makes ingestion wait until there is room in the queue.
+	OverflowBlock = "block"
+	// OverflowDropOldest evicts the root that has been pending the longest.
+	OverflowDropOldest = "drop-oldest"
+	// OverflowDropNewest discards the incoming root.
+	OverflowDropNewest = "drop-newest"
+	// OverflowSample keeps a uniform random sample of all roots that arrived while the queue was full.
+	OverflowSample = "sample"
+)
+
+// PendingRoot is a requested CID waiting to be fetched, along with the demand signals observed for it.
+type PendingRoot struct {
+	Cid     cid.Cid
+	Monitor string
+	// Peers are the distinct peers that requested the CID while it was pending.
+	Peers *Set[string]
+	// Priority is the highest Bitswap priority the CID was requested with.
+	Priority  int32
+	FirstSeen time.Time
+	LastSeen  time.Time
+
+	score float64
+	index int
+	// arrival is the root's element in the arrival order of pending roots.
+	arrival *list.Element
+}
+
+// FetchScheduler is a bounded priority queue between ingestion and fetching. When the fetcher cannot keep up,
+// the most demanded content is fetched first.
+//
+// Pending roots are ranked by the number of distinct requesting peers, their Bitswap priority and the recency of
+// the latest request. Recency is modelled as exponential decay with the given time constant: since all scores
+// decay at the same rate, it suffices to add the time of the latest request (in units of the time constant)
+// to the logarithmic demand score, which keeps scores of untouched roots constant.
+//
+// If the queue holds capacity roots, new roots are handled according to the overflow policy.
+// Further requests for roots that are already pending are always accepted.
+type FetchScheduler struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  map[cid.Cid]*PendingRoot
+	queue    rootQueue
+	arrivals *list.List
+	decay    time.Duration
+	capacity int
+	policy   string
+	// overflowed is the number of new roots that arrived since the queue became full (for sampling).
+	overflowed int
+	dropped    int64
+	closed     bool
+}
+
+// NewFetchScheduler creates an empty FetchScheduler whose recency signal decays with time constant decay.
+// A capacity of 0 leaves the queue unbounded.
+func NewFetchScheduler(decay time.Duration, capacity int, policy string) (*FetchScheduler, error) {
+	switch policy {
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowSample:
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q", policy)
+	}
+	if decay <= 0 {
+		return nil, fmt.Errorf("recency decay must be positive, got %s", decay)
+	}
+	s := &FetchScheduler{
+		pending:  map[cid.Cid]*PendingRoot{},
+		arrivals: list.New(),
+		decay:    decay,
+		capacity: capacity,
+		policy:   policy,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s, nil
+}
+
+// Push adds a requested CID to the queue, or updates its rank if it is already pending. If a root is dropped
+// according to the overflow policy, either the requested or an evicted one, its CID is returned; otherwise
+// Push returns cid.Undef.
+func (s *FetchScheduler) Push(ev Event, entry bsmsg.Entry) cid.Cid {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts := ev.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	var evicted cid.Cid
+	root, ok := s.pending[entry.Cid]
+	if !ok {
+		var room bool
+		if evicted, room = s.makeRoom(); !room {
+			s.dropped++
+			return entry.Cid
+		}
+	}
+	// the root may have been added by another request while waiting for room
+	if root, ok = s.pending[entry.Cid]; !ok {
+		root = &PendingRoot{
+			Cid:       entry.Cid,
+			Monitor:   ev.Monitor,
+			Peers:     NewSet[string](),
+			Priority:  entry.Priority,
+			FirstSeen: ts,
+		}
+		s.pending[entry.Cid] = root
+	}
+	s.update(root, ev, entry, ts)
+
+	if ok {
+		heap.Fix(&s.queue, root.index)
+	} else {
+		heap.Push(&s.queue, root)
+		root.arrival = s.arrivals.PushBack(root)
+		s.cond.Broadcast()
+	}
+	return evicted
+}
+
+// Touch updates the rank of a CID with another request for it if it is pending. Unlike Push, it never adds the
+// CID to the queue; it reports whether the CID was pending.
+func (s *FetchScheduler) Touch(ev Event, entry bsmsg.Entry) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	root, ok := s.pending[entry.Cid]
+	if !ok {
+		return false
+	}
+	ts := ev.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	s.update(root, ev, entry, ts)
+	heap.Fix(&s.queue, root.index)
+	return true
+}
+
+// update accounts for a request for a pending root at time ts and recomputes its score. The caller must hold
+// the lock and restore the heap order.
+func (s *FetchScheduler) update(root *PendingRoot, ev Event, entry bsmsg.Entry, ts time.Time) {
+	root.Peers.Add(ev.Peer)
+	if entry.Priority > root.Priority {
+		root.Priority = entry.Priority
+	}
+	if ts.After(root.LastSeen) {
+		root.LastSeen = ts
+	}
+	root.score = s.score(root)
+}
+
+// makeRoom ensures that there is space for a new root according to the overflow policy. It reports false if
+// the new root is to be discarded, and returns the CID of the root that was evicted to make room, if any.
+// The caller must hold the lock.
+func (s *FetchScheduler) makeRoom() (cid.Cid, bool) {
+	if s.capacity <= 0 || s.queue.Len() < s.capacity {
+		s.overflowed = 0
+		return cid.Undef, true
+	}
+	var evicted *PendingRoot
+	switch s.policy {
+	case OverflowBlock:
+		for s.queue.Len() >= s.capacity && !s.closed {
+			s.cond.Wait()
+		}
+		return cid.Undef, !s.closed
+	case OverflowDropOldest:
+		evicted = s.arrivals.Front().Value.(*PendingRoot)
+	case OverflowSample:
+		// reservoir sampling over all roots that were pending or arrived while the queue was full
+		s.overflowed++
+		if rand.Intn(s.capacity+s.overflowed) >= s.capacity {
+			return cid.Undef, false
+		}
+		evicted = s.queue[rand.Intn(s.queue.Len())]
+	default:
+		return cid.Undef, false
+	}
+	s.remove(evicted)
+	s.dropped++
+	return evicted.Cid, true
+}
+
+// remove takes a root out of the queue without fetching it. The caller must hold the lock.
+func (s *FetchScheduler) remove(root *PendingRoot) {
+	heap.Remove(&s.queue, root.index)
+	s.arrivals.Remove(root.arrival)
+	delete(s.pending, root.Cid)
+}
+
+// score computes the rank of a pending root.
+func (s *FetchScheduler) score(root *PendingRoot) float64 {
+	demand := math.Log(1 + float64(root.Peers.Size()))
+	priority := float64(root.Priority) / math.MaxInt32
+	recency := float64(root.LastSeen.UnixNano()) / float64(s.decay)
+	return demand + priority + recency
+}
+
+// Pop removes and returns the highest ranked root. It blocks while the queue is empty and returns false once
+// the scheduler is closed and drained.
+func (s *FetchScheduler) Pop() (*PendingRoot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.queue.Len() == 0 {
+		if s.closed {
+			return nil, false
+		}
+		s.cond.Wait()
+	}
+	root := s.queue[0]
+	s.remove(root)
+	s.cond.Broadcast()
+	return root, true
+}
+
+// Len returns the number of pending roots.
+func (s *FetchScheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queue.Len()
+}
+
+// Lag returns how far behind live traffic fetching is, i.e. the age of the request of the longest pending root.
+func (s *FetchScheduler) Lag() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.arrivals.Len() == 0 {
+		return 0
+	}
+	return time.Since(s.arrivals.Front().Value.(*PendingRoot).FirstSeen)
+}
+
+// Stats returns the state of the queue for monitoring.
+func (s *FetchScheduler) Stats() any {
+	lag := s.Lag()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]any{
+		"length":      s.queue.Len(),
+		"capacity":    s.capacity,
+		"policy":      s.policy,
+		"dropped":     s.dropped,
+		"lag_seconds": lag.Seconds(),
+	}
+}
+
+// ReportStats periodically logs the length of, and lag behind live traffic in, the queue.
+func (s *FetchScheduler) ReportStats(interval time.Duration) {
+	for range time.Tick(interval) {
+		stats := s.Stats().(map[string]any)
+		log.Printf("Fetch queue: %d pending, %d dropped, %.0fs behind live traffic.",
+			stats["length"], stats["dropped"], stats["lag_seconds"])
+	}
+}
+
+// Close lets Pop return once the remaining roots have been taken.
+func (s *FetchScheduler) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+// rootQueue implements heap.Interface as a max-heap on the score of pending roots.
+type rootQueue []*PendingRoot
+
+func (q rootQueue) Len() int           { return len(q) }
+func (q rootQueue) Less(i, j int) bool { return q[i].score > q[j].score }
+
+func (q rootQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *rootQueue) Push(x any) {
+	root := x.(*PendingRoot)
+	root.index = len(*q)
+	*q = append(*q, root)
+}
+
+func (q *rootQueue) Pop() any {
+	old := *q
+	n := len(old)
+	root := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return root
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestScheduler(t *testing.T, capacity int, policy string) *FetchScheduler {
+	s, err := NewFetchScheduler(time.Minute, capacity, policy)
+	assert.Nil(t, err)
+	return s
+}
+
+func TestNewFetchScheduler(t *testing.T) {
+	_, err := NewFetchScheduler(time.Minute, 10, "unknown")
+	assert.Error(t, err)
+	_, err = NewFetchScheduler(0, 10, OverflowBlock)
+	assert.Error(t, err)
+	_, err = NewFetchScheduler(-time.Minute, 10, OverflowBlock)
+	assert.Error(t, err)
+}
+
+func TestFetchScheduler(t *testing.T) {
+	now := time.Date(2023, 1, 19, 10, 0, 0, 0, time.UTC)
+	request := func(s *FetchScheduler, peer string, c string, priority int32, ts time.Time) cid.Cid {
+		entry := wantEntry(c, 0, false)
+		entry.Priority = priority
+		return s.Push(Event{Peer: peer, Timestamp: ts}, entry)
+	}
+	popAll := func(s *FetchScheduler) []string {
+		s.Close()
+		var cids []string
+		for root, ok := s.Pop(); ok; root, ok = s.Pop() {
+			cids = append(cids, root.Cid.String())
+		}
+		return cids
+	}
+
+	t.Run("more distinct peers rank higher", func(t *testing.T) {
+		s := newTestScheduler(t, 0, OverflowBlock)
+		request(s, "a", rawCID, 1, now)
+		request(s, "a", otherRawCID, 1, now)
+		request(s, "a", otherRawCID, 1, now)
+		request(s, "a", fileCID, 1, now)
+		request(s, "b", fileCID, 1, now)
+		assert.Equal(t, 3, s.Len())
+		assert.Equal(t, fileCID, popAll(s)[0])
+	})
+
+	t.Run("higher priority ranks higher", func(t *testing.T) {
+		s := newTestScheduler(t, 0, OverflowBlock)
+		request(s, "a", rawCID, 1, now)
+		request(s, "a", otherRawCID, 1<<30, now)
+		assert.Equal(t, []string{otherRawCID, rawCID}, popAll(s))
+	})
+
+	t.Run("recent requests outweigh stale demand", func(t *testing.T) {
+		s := newTestScheduler(t, 0, OverflowBlock)
+		request(s, "a", rawCID, 1, now.Add(-time.Hour))
+		request(s, "b", rawCID, 1, now.Add(-time.Hour))
+		request(s, "c", rawCID, 1, now.Add(-time.Hour))
+		request(s, "a", otherRawCID, 1, now)
+		assert.Equal(t, []string{otherRawCID, rawCID}, popAll(s))
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		s := newTestScheduler(t, 2, OverflowDropOldest)
+		request(s, "a", rawCID, 1, now)
+		request(s, "a", otherRawCID, 1, now.Add(time.Second))
+		assert.Equal(t, cid.Undef, request(s, "a", rawCID, 1<<30, now.Add(2*time.Second))) // update, not overflow
+		assert.Equal(t, cid.MustParse(rawCID), request(s, "a", fileCID, 1, now.Add(3*time.Second)))
+		assert.ElementsMatch(t, []string{otherRawCID, fileCID}, popAll(s))
+		assert.Equal(t, int64(1), s.Stats().(map[string]any)["dropped"])
+	})
+
+	t.Run("drop newest", func(t *testing.T) {
+		s := newTestScheduler(t, 2, OverflowDropNewest)
+		request(s, "a", rawCID, 1, now)
+		request(s, "a", otherRawCID, 1, now)
+		assert.Equal(t, cid.MustParse(fileCID), request(s, "a", fileCID, 1, now))
+		assert.ElementsMatch(t, []string{rawCID, otherRawCID}, popAll(s))
+	})
+
+	t.Run("sample keeps the queue bounded", func(t *testing.T) {
+		s := newTestScheduler(t, 1, OverflowSample)
+		for _, c := range []string{rawCID, otherRawCID, yetAnotherRawCID, fileCID, directoryCID} {
+			request(s, "a", c, 1, now)
+		}
+		assert.Equal(t, 1, s.Len())
+		assert.Equal(t, int64(4), s.Stats().(map[string]any)["dropped"])
+	})
+
+	t.Run("block waits for room", func(t *testing.T) {
+		s := newTestScheduler(t, 1, OverflowBlock)
+		request(s, "a", rawCID, 1, now)
+		pushed := make(chan struct{})
+		go func() {
+			request(s, "a", otherRawCID, 1, now)
+			close(pushed)
+		}()
+		select {
+		case <-pushed:
+			t.Fatal("push did not block")
+		case <-time.After(50 * time.Millisecond):
+		}
+		root, _ := s.Pop()
+		assert.Equal(t, rawCID, root.Cid.String())
+		<-pushed
+		assert.Equal(t, 1, s.Len())
+	})
+
+	t.Run("lag is the age of the longest pending request", func(t *testing.T) {
+		s := newTestScheduler(t, 0, OverflowBlock)
+		assert.Equal(t, time.Duration(0), s.Lag())
+		request(s, "a", rawCID, 1, time.Now().Add(-time.Minute))
+		request(s, "a", otherRawCID, 1, time.Now())
+		assert.InDelta(t, time.Minute.Seconds(), s.Lag().Seconds(), 1)
+	})
+
+	t.Run("pop blocks until a root is pushed", func(t *testing.T) {
+		s := newTestScheduler(t, 0, OverflowBlock)
+		popped := make(chan string)
+		go func() {
+			root, _ := s.Pop()
+			popped <- root.Cid.String()
+		}()
+		request(s, "a", rawCID, 1, now)
+		assert.Equal(t, rawCID, <-popped)
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// EventSource delivers batches of Bitswap events to the replicator.
+type EventSource interface {
+	// Stream decodes event batches and sends them to out until the source is exhausted or ctx is cancelled.
+	Stream(ctx context.Context, out chan<- Batch) error
+}
+
+// Batch is a set of events delivered by an EventSource.
+type Batch struct {
+	Events []Event
+	// Ack, if set, confirms to the source that the batch has been taken care of and need not be redelivered.
+	Ack func() error
+}
+
+// ReaderSource reads event batches from a stream of JSON lines. Each line holds either an array of events
+// (as written by --log-events) or a single event.
+type ReaderSource struct {
+	name string
+	r    io.Reader
+}
+
+// NewReaderSource creates an event source reading JSON lines from r. The name identifies the source in logs.
+func NewReaderSource(name string, r io.Reader) *ReaderSource {
+	return &ReaderSource{name: name, r: r}
+}
+
+// Stream implements EventSource.
+func (s *ReaderSource) Stream(ctx context.Context, out chan<- Batch) error {
+	return readEventLines(ctx, s.name, s.r, func(events []Event) error {
+		return sendBatch(ctx, out, Batch{Events: events})
+	})
+}
+
+// readEventLines decodes every non-empty line of r and passes the resulting batch to handle.
+// Malformed lines are put into quarantine, if enabled.
+func readEventLines(ctx context.Context, name string, r io.Reader, handle func([]Event) error) error {
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			events, decodeErr := decodeEvents(data)
+			if decodeErr != nil {
+				decodeErr = fmt.Errorf("line %d: %w", line, decodeErr)
+				if quarantine == nil {
+					return decodeErr
+				}
+				if err := quarantine.Put(QuarantineEntry{Source: name, Body: data}, decodeErr); err != nil {
+					return err
+				}
+			} else if err := handle(events); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// decodePayload decodes a message body with the given content encoding ("gzip" or empty) into a set of events.
+func decodePayload(body []byte, encoding string) ([]Event, error) {
+	if encoding == "gzip" {
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		if body, err = io.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	return decodeEvents(body)
+}
+
+// decodeEvents decodes a JSON array of events or a single JSON event.
+func decodeEvents(data []byte) ([]Event, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		var ev Event
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return nil, err
+		}
+		return []Event{ev}, nil
+	}
+	var events []Event
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// sendBatch passes a batch on to the pipeline unless ctx is cancelled first.
+func sendBatch(ctx context.Context, out chan<- Batch, batch Batch) error {
+	select {
+	case out <- batch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// setMonitor tags events of unknown provenance with the name of the monitor that observed them.
+func setMonitor(events []Event, monitor string) {
+	for i := range events {
+		if events[i].Monitor == "" {
+			events[i].Monitor = monitor
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// defaultMaxBodySize is the size limit of a POSTed batch in bytes if none is configured.
+const defaultMaxBodySize = 32 << 20
+
+// HTTPSource accepts event batches that are POSTed as JSON (optionally with gzip content encoding) to /events.
+// The originating monitor can be given with the monitor query parameter.
+type HTTPSource struct {
+	Addr string
+	// MaxBodySize is the size limit of a request body in bytes, larger batches are rejected (0 = 32 MiB).
+	MaxBodySize int64
+}
+
+// Stream implements EventSource.
+func (s *HTTPSource) Stream(ctx context.Context, out chan<- Batch) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.handleEvents(ctx, out))
+
+	srv := &http.Server{Addr: s.Addr, Handler: mux}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	log.Printf("Accepting events on http://%s/events", s.Addr)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	// wait for in-flight requests so that nothing is sent after the stream ended
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return ctx.Err()
+}
+
+// handleEvents returns the handler that decodes POSTed batches and sends them to out.
+func (s *HTTPSource) handleEvents(ctx context.Context, out chan<- Batch) http.HandlerFunc {
+	maxBodySize := s.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMaxBodySize
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		monitor := r.URL.Query().Get("monitor")
+		encoding := r.Header.Get("Content-Encoding")
+		events, err := decodePayload(body, encoding)
+		if err != nil {
+			if quarantine != nil {
+				if err := quarantine.Put(QuarantineEntry{Source: "http", Monitor: monitor, Encoding: encoding, Body: body}, err); err != nil {
+					log.Printf("error quarantining malformed batch: %v", err)
+				}
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setMonitor(events, monitor)
+		select {
+		case out <- Batch{Events: events}:
+			w.WriteHeader(http.StatusAccepted)
+		case <-ctx.Done():
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		case <-r.Context().Done():
+		}
+	}
+}
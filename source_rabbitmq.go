@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/trudi-group/ipfs-metric-exporter/metricplugin"
+)
+
+// maxReconnectDelay caps the backoff between attempts to reconnect to RabbitMQ.
+const maxReconnectDelay = time.Minute
+
+// RabbitMQSource consumes the gzipped event batches that the IPFS Metric Exporter publishes to RabbitMQ.
+// Messages are consumed from a durable queue and only acknowledged once their batch has been processed,
+// so that nothing is lost if the replicator dies. Lost connections are re-established automatically.
+type RabbitMQSource struct {
+	URL string
+	// Queue is the name prefix of the durable queue that buffers messages while the replicator is not consuming
+	// (see queueName).
+	Queue string
+	// Prefetch is the maximum number of unacknowledged messages delivered to the replicator.
+	Prefetch int
+	// RoutingKeys are the keys (possibly containing wildcards) that the queue is bound to, one per monitor.
+	RoutingKeys []string
+}
+
+// Stream implements EventSource.
+func (s *RabbitMQSource) Stream(ctx context.Context, out chan<- Batch) error {
+	delay := time.Second
+	for {
+		err := s.consume(ctx, out, func() { delay = time.Second })
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("RabbitMQ connection lost (%v). Reconnecting in %s...", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// consume sets up a connection, channel and queue binding and forwards deliveries until the connection breaks.
+// connected is called once consumption has started.
+func (s *RabbitMQSource) consume(ctx context.Context, out chan<- Batch, connected func()) error {
+	rmq, err := amqp.Dial(s.URL)
+	if err != nil {
+		return err
+	}
+	defer rmq.Close()
+
+	ch, err := rmq.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := ch.Qos(s.Prefetch, 0, false); err != nil {
+		return err
+	}
+
+	if err := ch.ExchangeDeclare(
+		metricplugin.ExchangeName, "topic", false, false, false, false, nil,
+	); err != nil {
+		return err
+	}
+
+	q, err := ch.QueueDeclare(s.queueName(), true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range s.RoutingKeys {
+		if err := ch.QueueBind(q.Name, key, metricplugin.ExchangeName, false, nil); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Consuming from RabbitMQ queue %s.", q.Name)
+	msgs, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	connected()
+	closed := rmq.NotifyClose(make(chan *amqp.Error, 1))
+
+	for {
+		select {
+		case d, ok := <-msgs:
+			if !ok {
+				return amqp.ErrClosed
+			}
+			monitor := monitorFromRoutingKey(d.RoutingKey)
+			events, err := decodePayload(d.Body, "gzip")
+			if err != nil {
+				// redelivering the message would not help
+				if err := s.deadLetter(d, monitor, err); err != nil {
+					return err
+				}
+				continue
+			}
+			setMonitor(events, monitor)
+			if err := sendBatch(ctx, out, Batch{
+				Events: events,
+				Ack:    func() error { return d.Ack(false) },
+			}); err != nil {
+				return err
+			}
+		case err := <-closed:
+			if err == nil {
+				return amqp.ErrClosed
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// queueName returns the name of the queue for the configured routing keys. The bindings of a durable queue outlive
+// the replicator, so each set of keys gets its own queue: otherwise, monitors that are no longer configured would
+// keep delivering into the queue after a restart.
+func (s *RabbitMQSource) queueName() string {
+	keys := append([]string(nil), s.RoutingKeys...)
+	sort.Strings(keys)
+	sum := sha256.Sum256([]byte(strings.Join(keys, "\n")))
+	return s.Queue + "." + hex.EncodeToString(sum[:4])
+}
+
+// deadLetter moves a malformed delivery to the quarantine, or rejects it if there is no quarantine.
+func (s *RabbitMQSource) deadLetter(d amqp.Delivery, monitor string, reason error) error {
+	if quarantine == nil {
+		log.Printf("Rejecting malformed message: %v", reason)
+		return d.Reject(false)
+	}
+	if err := quarantine.Put(QuarantineEntry{
+		Source:   "rabbitmq",
+		Monitor:  monitor,
+		Encoding: "gzip",
+		Body:     d.Body,
+	}, reason); err != nil {
+		log.Printf("error quarantining message: %v", err)
+		return d.Reject(false)
+	}
+	return d.Ack(false)
+}
+
+// monitorFromRoutingKey extracts the name of the originating monitor from a routing key (see routingKeyFmt).
+func monitorFromRoutingKey(key string) string {
+	prefix, suffix, _ := strings.Cut(routingKeyFmt, "%s")
+	if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, suffix) {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(key, prefix), suffix)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testEventLog = `[{"timestamp":"2023-01-19T10:00:00Z","peer":"12D3KooWA","bitswap_message":{"wantlist_entries":[{"Cid":{"/":"` + rawCID + `"},"Priority":1,"WantType":0,"Cancel":false,"SendDontHave":false}],"full_wantlist":false,"blocks":[],"block_presences":[],"connected_addresses":[]}}]
+
+{"timestamp":"2023-01-19T10:00:01Z","peer":"12D3KooWB","bitswap_message":{"wantlist_entries":[{"Cid":{"/":"` + fileCID + `"},"Priority":1,"WantType":1,"Cancel":false,"SendDontHave":true}],"full_wantlist":true,"blocks":[],"block_presences":[],"connected_addresses":[]}}
+`
+
+func collectBatches(t *testing.T, source EventSource) [][]Event {
+	out := make(chan Batch)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(out)
+		errc <- source.Stream(context.Background(), out)
+	}()
+	var batches [][]Event
+	for batch := range out {
+		batches = append(batches, batch.Events)
+	}
+	assert.Nil(t, <-errc)
+	return batches
+}
+
+func TestReaderSource_Stream(t *testing.T) {
+	batches := collectBatches(t, NewReaderSource("test", strings.NewReader(testEventLog)))
+
+	assert.Len(t, batches, 2)
+	assert.Equal(t, "12D3KooWA", batches[0][0].Peer)
+	assert.Equal(t, rawCID, batches[0][0].BitswapMessage.WantlistEntries[0].Cid.String())
+	assert.Equal(t, "12D3KooWB", batches[1][0].Peer)
+	assert.True(t, batches[1][0].BitswapMessage.FullWantList)
+	assert.True(t, batches[1][0].BitswapMessage.WantlistEntries[0].SendDontHave)
+}
+
+func TestReaderSource_StreamInvalid(t *testing.T) {
+	err := NewReaderSource("test", strings.NewReader("not json\n")).Stream(context.Background(), make(chan Batch, 1))
+	assert.ErrorContains(t, err, "line 1")
+}
+
+func TestFileSource_Stream(t *testing.T) {
+	dir := t.TempDir()
+	plainPath := filepath.Join(dir, "plain.json")
+	assert.Nil(t, os.WriteFile(plainPath, []byte(testEventLog), 0644))
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte(testEventLog))
+	gw.Close()
+	gzPath := filepath.Join(dir, "compressed.json.gz")
+	assert.Nil(t, os.WriteFile(gzPath, buf.Bytes(), 0644))
+
+	batches := collectBatches(t, &FileSource{Paths: []string{plainPath, gzPath}})
+	assert.Len(t, batches, 4)
+	assert.Equal(t, batches[0], batches[2])
+	assert.Equal(t, batches[1], batches[3])
+}
+
+func TestFileSource_Speed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.json")
+	assert.Nil(t, os.WriteFile(path, []byte(testEventLog), 0644))
+
+	// replaySpacing returns the time between the replays of the two batches, which were recorded a second apart
+	replaySpacing := func(speed float64) time.Duration {
+		out := make(chan Batch)
+		go func() {
+			defer close(out)
+			assert.Nil(t, (&FileSource{Paths: []string{path}, Speed: speed}).Stream(context.Background(), out))
+		}()
+		var received []time.Time
+		for range out {
+			received = append(received, time.Now())
+		}
+		if !assert.Len(t, received, 2) {
+			return 0
+		}
+		return received[1].Sub(received[0])
+	}
+
+	assert.InDelta(t, 0.5, replaySpacing(2).Seconds(), 0.1)
+	assert.InDelta(t, 0.25, replaySpacing(4).Seconds(), 0.1)
+	assert.Less(t, replaySpacing(0).Seconds(), 0.1)
+}
+
+func TestHTTPSource_BodyLimit(t *testing.T) {
+	out := make(chan Batch, 1)
+	handler := (&HTTPSource{MaxBodySize: 16}).handleEvents(context.Background(), out)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(testEventLog)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Empty(t, out)
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/events", strings.NewReader("[]")))
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Len(t, out, 1)
+}
+
+func TestMonitorFromRoutingKey(t *testing.T) {
+	assert.Equal(t, "docker_compose_monitor_01", monitorFromRoutingKey("monitor.docker_compose_monitor_01.bitswap_messages"))
+	assert.Equal(t, "eu.monitor", monitorFromRoutingKey("monitor.eu.monitor.bitswap_messages"))
+	assert.Equal(t, "", monitorFromRoutingKey("monitor.x.connection_events"))
+}
+
+func TestRabbitMQSource_QueueName(t *testing.T) {
+	a := &RabbitMQSource{Queue: "q", RoutingKeys: []string{"monitor.a.bitswap_messages", "monitor.b.bitswap_messages"}}
+	b := &RabbitMQSource{Queue: "q", RoutingKeys: []string{"monitor.b.bitswap_messages", "monitor.a.bitswap_messages"}}
+	c := &RabbitMQSource{Queue: "q", RoutingKeys: []string{"monitor.a.bitswap_messages"}}
+	assert.True(t, strings.HasPrefix(a.queueName(), "q."))
+	assert.Equal(t, a.queueName(), b.queueName())
+	// removing a monitor switches to a queue without its binding
+	assert.NotEqual(t, a.queueName(), c.queueName())
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	ft "github.com/ipfs/go-unixfs"
+	"github.com/multiformats/go-multicodec"
+	rg "github.com/redislabs/redisgraph-go"
+)
+
+// Traversal states of :Block nodes (property state).
+//
+// A block is created as pending, either as a requested root or as the child of an expanded block. Once its
+// links are known and its children exist in the graph, it is expanded. A block is complete once its data is
+// stored and all of its children are complete. Blocks that could not be retrieved are failed.
+// Blocks without a state have not been traversed yet, e.g. because they were only observed in Bitswap messages
+// or were created by an earlier version. Failed blocks are retrieved again by the retry queue or by the next
+// traversal that reaches them.
+const (
+	StatePending  = "pending"
+	StateExpanded = "expanded"
+	StateComplete = "complete"
+	StateFailed   = "failed"
+)
+
+// mergeBlock creates the node of a block if it does not exist yet and returns its traversal state.
+func (f *IPFSFetcher) mergeBlock(_cid cid.Cid, monitor string) string {
+	node := newNode(_cid)
+	qr, err := f.graph.Query(fmt.Sprintf(
+		"MERGE %s%s%s RETURN %s.state",
+		node.Encode(),
+		onCreateSetMonitor(node.Alias, monitor),
+		setPendingIfNew(node.Alias),
+		node.Alias,
+	))
+	if err != nil {
+		log.Fatalf("failed to merge node of CID %s: %v", _cid.String(), err)
+	}
+	if qr.NodesCreated() > 0 {
+		log.Println("Node added: " + _cid.String())
+	}
+	if !qr.Next() {
+		return StatePending
+	}
+	state, _ := qr.Record().GetByIndex(0).(string)
+	return state
+}
+
+// mergeChildren creates the children of an expanded block along with one edge per link. Edges preserve the
+// position of the link (index), its name and the cumulative size of the linked DAG, such that repeated links
+// (e.g. duplicate chunks of a file) result in multiple edges to the same child.
+func (f *IPFSFetcher) mergeChildren(parent cid.Cid, fsNode *ft.FSNode, links []*format.Link, monitor string) {
+	entries := make([]string, len(links))
+	for i, props := range linkProperties(fsNode, links) {
+		props["cid"] = links[i].Cid.String()
+		props["codec"] = multicodec.Code(links[i].Cid.Type()).String()
+		entries[i] = encodeProperties(props)
+	}
+	if _, err := f.graph.Query(fmt.Sprintf(
+		"MATCH (a:Block {cid: '%s'}) UNWIND [%s] AS l "+
+			"MERGE (b:Block {cid: l.cid, codec: l.codec})%s%s "+
+			"MERGE (a)-[e:has {index: l.index}]->(b)%s SET e.name = l.name, e.size = l.size, e.bucket = l.bucket",
+		parent.String(),
+		strings.Join(entries, ", "),
+		onCreateSetMonitor("b", monitor),
+		setPendingIfNew("b"),
+		onCreateSetMonitor("e", monitor),
+	)); err != nil {
+		log.Fatalf("failed to merge children of CID %s: %v", parent.String(), err)
+	}
+	log.Printf("Edges added: %s has %d links", parent.String(), len(links))
+}
+
+// children returns the children of an expanded block that are not complete yet, and those of them that are
+// entries of the block as a directory.
+func (f *IPFSFetcher) children(_cid cid.Cid) (children, entries []cid.Cid) {
+	qr, err := f.graph.Query(fmt.Sprintf(
+		"MATCH (p:Block {cid: '%s'})-[e:has]->(c:Block) WHERE c.state IS NULL OR c.state <> '%s' "+
+			// a child linked more than once is an entry if any of its links is named
+			"WITH c, max(CASE WHEN p.type IN ['Directory', 'HAMTShard'] AND e.name <> '' THEN 1 ELSE 0 END) AS entry "+
+			"RETURN c.cid, entry = 1",
+		_cid.String(), StateComplete,
+	))
+	if err != nil {
+		log.Fatalf("failed to query children of CID %s: %v", _cid.String(), err)
+	}
+	for qr.Next() {
+		child, err := cid.Parse(qr.Record().GetByIndex(0))
+		if err != nil {
+			continue
+		}
+		children = append(children, child)
+		if entry, _ := qr.Record().GetByIndex(1).(bool); entry {
+			entries = append(entries, child)
+		}
+	}
+	return children, entries
+}
+
+// setState sets the traversal state of a block.
+func (f *IPFSFetcher) setState(_cid cid.Cid, state string) {
+	if _, err := f.graph.Query(fmt.Sprintf(
+		"MATCH (b:Block {cid: '%s'}) SET b.state = '%s'", _cid.String(), state,
+	)); err != nil {
+		log.Fatalf("failed to set state of CID %s: %v", _cid.String(), err)
+	}
+}
+
+// complete marks a block as complete and propagates completion to its ancestors.
+func (f *IPFSFetcher) complete(_cid cid.Cid) {
+	if _, err := f.graph.Query(fmt.Sprintf(
+		"MATCH (b:Block {cid: '%s'}) SET b.state = '%s'%s", _cid.String(), StateComplete, clearTruncated("b"),
+	)); err != nil {
+		log.Fatalf("failed to set state of CID %s: %v", _cid.String(), err)
+	}
+	if f.takeFile(_cid) {
+		f.classify(_cid)
+	}
+	f.completeParents(_cid)
+}
+
+// completeIfDone marks an expanded block as complete if all of its children are complete, and propagates
+// completion to its ancestors.
+func (f *IPFSFetcher) completeIfDone(_cid cid.Cid) {
+	qr, err := f.graph.Query(fmt.Sprintf(
+		"MATCH (p:Block {cid: '%s'})-[:has]->(c:Block) "+
+			"WITH p, count(c) AS total, sum(CASE WHEN c.state = '%s' THEN 1 ELSE 0 END) AS done "+
+			"WHERE p.state = '%s' AND done = total SET p.state = '%s'%s",
+		_cid.String(), StateComplete, StateExpanded, StateComplete, clearTruncated("p"),
+	))
+	if err != nil {
+		log.Fatalf("failed to update state of CID %s: %v", _cid.String(), err)
+	}
+	if qr.PropertiesSet() > 0 {
+		if f.takeFile(_cid) {
+			f.classify(_cid)
+		}
+		f.completeParents(_cid)
+	}
+}
+
+// completeParents checks whether the expanded parents of a completed block are complete now.
+func (f *IPFSFetcher) completeParents(_cid cid.Cid) {
+	qr, err := f.graph.Query(fmt.Sprintf(
+		"MATCH (p:Block)-[:has]->(:Block {cid: '%s'}) WHERE p.state = '%s' RETURN DISTINCT p.cid",
+		_cid.String(), StateExpanded,
+	))
+	if err != nil {
+		log.Fatalf("failed to query parents of CID %s: %v", _cid.String(), err)
+	}
+	var parents []cid.Cid
+	for qr.Next() {
+		if parent, err := cid.Parse(qr.Record().GetByIndex(0)); err == nil {
+			parents = append(parents, parent)
+		}
+	}
+	for _, parent := range parents {
+		f.completeIfDone(parent)
+	}
+}
+
+// fail marks a block as failed, records the error on its node and schedules another attempt if any are left.
+// The root of the traversal is forgotten by the deduplicator, so that it is traversed again when requested.
+func (f *IPFSFetcher) fail(t *traversal, _cid cid.Cid, cause error) {
+	if isTimeout(cause) {
+		log.Printf("Timeout for CID %s. Skip!", _cid.String())
+	} else {
+		log.Printf("Retrieval of CID %s failed with error: %v", _cid.String(), cause)
+	}
+
+	qr, err := f.graph.Query(fmt.Sprintf(
+		"MATCH (b:Block {cid: '%s'}) "+
+			"SET b.state = '%s', b.attempts = coalesce(b.attempts, 0) + 1, b.last_error = %s "+
+			"RETURN b.attempts",
+		_cid.String(), StateFailed, rg.ToString(cause.Error()),
+	))
+	if err != nil {
+		log.Fatalf("failed to set state of CID %s: %v", _cid.String(), err)
+	}
+	t.fail(_cid)
+	f.forget(t)
+	if f.Retries == nil || !qr.Next() {
+		return
+	}
+	attempts, _ := qr.Record().GetByIndex(0).(int)
+	scheduled, err := f.Retries.Schedule(_cid, attempts)
+	if err != nil {
+		log.Printf("failed to schedule retry of CID %s: %v", _cid.String(), err)
+	} else if scheduled {
+		log.Printf("Retrying CID %s in %s (attempt %d).", _cid.String(), f.Retries.delay(attempts), attempts+1)
+	} else {
+		log.Printf("Giving up on CID %s after %d attempts.", _cid.String(), attempts)
+	}
+}
+
+// Retry traverses failed blocks again, along with their descendants. The blocks are traversed by one pool of
+// workers. Blocks that are no longer failed are skipped.
+func (f *IPFSFetcher) Retry(cids ...cid.Cid) {
+	var roots []traversalRoot
+	for _, _cid := range cids {
+		qr, err := f.graph.Query(fmt.Sprintf(
+			"MATCH (b:Block {cid: '%s'}) WHERE b.state = '%s' SET b.state = '%s' RETURN b.monitor",
+			_cid.String(), StateFailed, StatePending,
+		))
+		if err != nil {
+			log.Fatalf("failed to set state of CID %s: %v", _cid.String(), err)
+		}
+		if !qr.Next() {
+			continue
+		}
+		monitor, _ := qr.Record().GetByIndex(0).(string)
+		roots = append(roots, traversalRoot{_cid, monitor, false})
+	}
+	if len(roots) > 0 {
+		f.traverse(roots...)
+	}
+}
+
+// setTruncated records on the root of a traversal that the traversal was truncated by the given limit. Roots that
+// are complete nonetheless, e.g. because the blocks that exceeded the budget were replicated before, are left as is.
+func (f *IPFSFetcher) setTruncated(root cid.Cid, reason string) {
+	if _, err := f.graph.Query(fmt.Sprintf(
+		"MATCH (b:Block {cid: '%s'}) WHERE b.state <> '%s' SET b.truncated = true, b.truncated_by = '%s'",
+		root.String(), StateComplete, reason,
+	)); err != nil {
+		log.Fatalf("failed to update truncation of CID %s: %v", root.String(), err)
+	}
+}
+
+// clearTruncated returns a clause that clears the truncation of a block that becomes complete, since nothing
+// below it is pending anymore. Blocks that were never truncated are left without the property.
+func clearTruncated(alias string) string {
+	return fmt.Sprintf(
+		", %s.truncated = CASE WHEN %s.truncated IS NULL THEN NULL ELSE false END, %s.truncated_by = NULL",
+		alias, alias, alias,
+	)
+}
+
+// Resume finishes the traversals that were interrupted in a previous run. Each incomplete block whose parents
+// are all complete (or that has no parent) is traversed again; blocks that are complete already are skipped.
+// Roots whose traversal was truncated by its budget are only continued when they are requested again.
+// Blocks that were requested by a peer are classified as files, like roots of Download.
+func (f *IPFSFetcher) Resume() {
+	qr, err := f.graph.Query(fmt.Sprintf(
+		"MATCH (b:Block) WHERE b.state IN ['%s', '%s'] AND NOT coalesce(b.truncated, false) "+
+			"OPTIONAL MATCH (p:Block)-[:has]->(b) WHERE p.state IN ['%s', '%s'] "+
+			"WITH b, count(p) AS open WHERE open = 0 "+
+			"OPTIONAL MATCH (:Peer)-[r:requested]->(b) WITH b, count(r) AS requests "+
+			"RETURN b.cid, b.monitor, requests > 0",
+		StatePending, StateExpanded, StatePending, StateExpanded,
+	))
+	if err != nil {
+		log.Fatalf("failed to query incomplete traversals: %v", err)
+	}
+	var roots []traversalRoot
+	for qr.Next() {
+		r, err := cid.Parse(qr.Record().GetByIndex(0))
+		if err != nil {
+			continue
+		}
+		monitor, _ := qr.Record().GetByIndex(1).(string)
+		requested, _ := qr.Record().GetByIndex(2).(bool)
+		roots = append(roots, traversalRoot{r, monitor, requested})
+	}
+
+	log.Printf("Resuming %d incomplete traversals...", len(roots))
+	for _, r := range roots {
+		f.traverse(r)
+	}
+}
+
+// markPending marks requested blocks as pending unless they already have a traversal state, such that Resume
+// fetches them if they are not fetched before a restart.
+func (f *IPFSFetcher) markPending(cids []cid.Cid) {
+	entries := make([]string, len(cids))
+	for i, _cid := range cids {
+		entries[i] = rg.ToString(_cid.String())
+	}
+	if _, err := f.graph.Query(fmt.Sprintf(
+		"UNWIND [%s] AS c MATCH (b:Block {cid: c})%s",
+		strings.Join(entries, ", "),
+		setPendingIfNew("b"),
+	)); err != nil {
+		log.Fatalf("failed to mark requested CIDs as pending: %v", err)
+	}
+}
+
+// setPendingIfNew returns a clause that marks a block as pending unless it already has a traversal state.
+func setPendingIfNew(alias string) string {
+	return fmt.Sprintf(" SET %s.state = coalesce(%s.state, '%s')", alias, alias, StatePending)
+}
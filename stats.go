@@ -0,0 +1,262 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/multiformats/go-multicodec"
+)
+
+// statsKeyPrefix is the prefix of the Redis keys that window statistics are stored under.
+const statsKeyPrefix = "stats"
+
+// statsLateEvents counts the events that arrived after their window was persisted and were dropped.
+var statsLateEvents = expvar.NewInt("stats_late_events")
+
+// WindowStats summarises the wants of a time window.
+type WindowStats struct {
+	Start, End time.Time
+	// Wants is the number of requested CIDs (cancels excluded).
+	Wants int
+	// CIDs is the number of distinct requested CIDs.
+	CIDs int
+	// TopCIDs are the most requested CIDs, in descending order of wants.
+	TopCIDs []CIDStats
+	// PeerWants is the number of wants per peer.
+	PeerWants map[string]int
+	// Codecs and CIDVersions count the wants per codec name and CID version.
+	Codecs      map[string]int
+	CIDVersions map[string]int
+}
+
+// CIDStats are the wants of a CID in a window.
+type CIDStats struct {
+	CID   string
+	Wants int
+	// Peers is the number of distinct peers that requested the CID.
+	Peers int
+}
+
+// window collects the wants of a time window until it is closed.
+type window struct {
+	start       time.Time
+	wants       int
+	cidWants    map[string]int
+	cidPeers    map[string]map[string]struct{}
+	peerWants   map[string]int
+	codecs      map[string]int
+	cidVersions map[string]int
+}
+
+func newWindow(start time.Time) *window {
+	return &window{
+		start:       start,
+		cidWants:    map[string]int{},
+		cidPeers:    map[string]map[string]struct{}{},
+		peerWants:   map[string]int{},
+		codecs:      map[string]int{},
+		cidVersions: map[string]int{},
+	}
+}
+
+// StatsAggregator aggregates wants into tumbling time windows by event timestamp and persists a summary of
+// each window to Redis once it is closed. A window is closed when an event of a window two sizes later
+// arrives, i.e. events may arrive up to one window late. Later events are dropped, since the distinct counts of a
+// persisted window cannot be updated.
+type StatsAggregator struct {
+	conn      redis.Conn
+	size      time.Duration
+	topN      int
+	retention time.Duration
+
+	mu      sync.Mutex
+	windows map[int64]*window
+	latest  time.Time
+	// closed is the start of the earliest window that is still open; earlier windows have been persisted.
+	closed time.Time
+}
+
+// NewStatsAggregator creates a StatsAggregator that stores the topN CIDs of windows of the given size in Redis.
+// Stored windows expire after retention (0 keeps them).
+func NewStatsAggregator(conn redis.Conn, size time.Duration, topN int, retention time.Duration) *StatsAggregator {
+	return &StatsAggregator{
+		conn:      conn,
+		size:      size,
+		topN:      topN,
+		retention: retention,
+		windows:   map[int64]*window{},
+	}
+}
+
+// Write implements EventSink.
+func (a *StatsAggregator) Write(events []Event) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, ev := range events {
+		a.add(ev)
+	}
+	for _, stats := range a.closeWindows(a.latest.Add(-a.size).Truncate(a.size)) {
+		if err := a.persist(stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close persists all open windows.
+func (a *StatsAggregator) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, stats := range a.closeWindows(time.Time{}) {
+		if err := a.persist(stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add counts the wants of an event in its window.
+func (a *StatsAggregator) add(ev Event) {
+	start := ev.Timestamp.Truncate(a.size)
+	if start.Before(a.closed) {
+		statsLateEvents.Add(1)
+		return
+	}
+	w, ok := a.windows[start.UnixNano()]
+	if !ok {
+		w = newWindow(start)
+		a.windows[start.UnixNano()] = w
+	}
+	if ev.Timestamp.After(a.latest) {
+		a.latest = ev.Timestamp
+	}
+
+	for _, entry := range ev.BitswapMessage.WantlistEntries {
+		if entry.Cancel {
+			continue
+		}
+		key := entry.Cid.String()
+		w.wants++
+		w.cidWants[key]++
+		if w.cidPeers[key] == nil {
+			w.cidPeers[key] = map[string]struct{}{}
+		}
+		w.cidPeers[key][ev.Peer] = struct{}{}
+		w.peerWants[ev.Peer]++
+		w.codecs[multicodec.Code(entry.Cid.Prefix().Codec).String()]++
+		w.cidVersions[fmt.Sprintf("v%d", entry.Cid.Version())]++
+	}
+}
+
+// closeWindows removes the windows that start before the given time (all windows for the zero time) and returns
+// their statistics in chronological order.
+func (a *StatsAggregator) closeWindows(before time.Time) []WindowStats {
+	if before.After(a.closed) {
+		a.closed = before
+	}
+	var closed []WindowStats
+	for key, w := range a.windows {
+		if before.IsZero() || w.start.Before(before) {
+			closed = append(closed, a.summarise(w))
+			delete(a.windows, key)
+		}
+	}
+	sort.Slice(closed, func(i, j int) bool { return closed[i].Start.Before(closed[j].Start) })
+	return closed
+}
+
+// summarise computes the statistics of a window.
+func (a *StatsAggregator) summarise(w *window) WindowStats {
+	stats := WindowStats{
+		Start:       w.start,
+		End:         w.start.Add(a.size),
+		Wants:       w.wants,
+		CIDs:        len(w.cidWants),
+		PeerWants:   w.peerWants,
+		Codecs:      w.codecs,
+		CIDVersions: w.cidVersions,
+	}
+	for c, wants := range w.cidWants {
+		stats.TopCIDs = append(stats.TopCIDs, CIDStats{CID: c, Wants: wants, Peers: len(w.cidPeers[c])})
+	}
+	sort.Slice(stats.TopCIDs, func(i, j int) bool {
+		if stats.TopCIDs[i].Wants != stats.TopCIDs[j].Wants {
+			return stats.TopCIDs[i].Wants > stats.TopCIDs[j].Wants
+		}
+		return stats.TopCIDs[i].CID < stats.TopCIDs[j].CID
+	})
+	if len(stats.TopCIDs) > a.topN {
+		stats.TopCIDs = stats.TopCIDs[:a.topN]
+	}
+	return stats
+}
+
+// persist writes the statistics of a window to Redis:
+//
+//	stats:windows                  sorted set of window start times (unix seconds)
+//	stats:<start>                  hash with start, end, wants, peers and cids (distinct counts) of the window
+//	stats:<start>:top_cids         sorted set of the top CIDs by wants
+//	stats:<start>:cid_peers        sorted set of the top CIDs by distinct peers
+//	stats:<start>:peer_wants       sorted set of peers by wants
+//	stats:<start>:codecs           hash of wants per codec
+//	stats:<start>:cid_versions     hash of wants per CID version
+func (a *StatsAggregator) persist(stats WindowStats) error {
+	start := strconv.FormatInt(stats.Start.Unix(), 10)
+	key := statsKeyPrefix + ":" + start
+
+	a.conn.Send("MULTI")
+	a.conn.Send("HSET", key,
+		"start", stats.Start.Unix(),
+		"end", stats.End.Unix(),
+		"wants", stats.Wants,
+		"peers", len(stats.PeerWants),
+		"cids", stats.CIDs,
+	)
+	keys := []string{key}
+	if len(stats.TopCIDs) > 0 {
+		topArgs := redis.Args{key + ":top_cids"}
+		peerArgs := redis.Args{key + ":cid_peers"}
+		for _, c := range stats.TopCIDs {
+			topArgs = topArgs.Add(c.Wants, c.CID)
+			peerArgs = peerArgs.Add(c.Peers, c.CID)
+		}
+		a.conn.Send("ZADD", topArgs...)
+		a.conn.Send("ZADD", peerArgs...)
+		keys = append(keys, key+":top_cids", key+":cid_peers")
+	}
+	if len(stats.PeerWants) > 0 {
+		args := redis.Args{key + ":peer_wants"}
+		for peer, wants := range stats.PeerWants {
+			args = args.Add(wants, peer)
+		}
+		a.conn.Send("ZADD", args...)
+		keys = append(keys, key+":peer_wants")
+	}
+	if len(stats.Codecs) > 0 {
+		a.conn.Send("HSET", redis.Args{key + ":codecs"}.AddFlat(stats.Codecs)...)
+		a.conn.Send("HSET", redis.Args{key + ":cid_versions"}.AddFlat(stats.CIDVersions)...)
+		keys = append(keys, key+":codecs", key+":cid_versions")
+	}
+	a.conn.Send("ZADD", statsKeyPrefix+":windows", stats.Start.Unix(), start)
+	if a.retention > 0 {
+		for _, k := range keys {
+			a.conn.Send("EXPIRE", k, int(a.retention.Seconds()))
+		}
+		a.conn.Send("ZREMRANGEBYSCORE", statsKeyPrefix+":windows", "-inf", stats.End.Add(-a.retention).Unix())
+	}
+	if _, err := a.conn.Do("EXEC"); err != nil {
+		return fmt.Errorf("error persisting statistics of window %s: %w", stats.Start.Format(time.RFC3339), err)
+	}
+
+	log.Printf("Window %s: %d wants by %d peers for %d CIDs",
+		stats.Start.Format(time.RFC3339), stats.Wants, len(stats.PeerWants), stats.CIDs)
+	return nil
+}
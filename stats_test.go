@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func wantEvent(ts time.Time, peer string, entries ...bsmsg.Entry) Event {
+	return Event{Timestamp: ts, Peer: peer, BitswapMessage: BitswapMessage{WantlistEntries: entries}}
+}
+
+func TestStatsAggregator_Windows(t *testing.T) {
+	a := NewStatsAggregator(nil, time.Minute, 1, 0)
+	ts := time.Date(2023, 1, 19, 10, 0, 0, 0, time.UTC)
+
+	a.add(wantEvent(ts, "A", wantEntry(rawCID, pb.Message_Wantlist_Block, false), wantEntry(fileCID, pb.Message_Wantlist_Have, false)))
+	a.add(wantEvent(ts.Add(10*time.Second), "B", wantEntry(rawCID, pb.Message_Wantlist_Block, false)))
+	a.add(wantEvent(ts.Add(20*time.Second), "B", wantEntry(rawCID, pb.Message_Wantlist_Block, true)))
+	a.add(wantEvent(ts.Add(time.Minute), "C", wantEntry(fileCID, pb.Message_Wantlist_Block, false)))
+
+	// only the first window is closed once an event of the second window has arrived
+	closed := a.closeWindows(a.latest.Add(-a.size).Truncate(a.size))
+	assert.Empty(t, closed)
+	closed = a.closeWindows(ts.Add(time.Minute))
+	assert.Len(t, closed, 1)
+
+	stats := closed[0]
+	assert.Equal(t, ts, stats.Start)
+	assert.Equal(t, ts.Add(time.Minute), stats.End)
+	assert.Equal(t, 3, stats.Wants)
+	assert.Equal(t, 2, stats.CIDs)
+	assert.Equal(t, []CIDStats{{CID: rawCID, Wants: 2, Peers: 2}}, stats.TopCIDs)
+	assert.Equal(t, map[string]int{"A": 2, "B": 1}, stats.PeerWants)
+	assert.Equal(t, map[string]int{"raw": 2, "dag-pb": 1}, stats.Codecs)
+	assert.Equal(t, map[string]int{"v1": 3}, stats.CIDVersions)
+
+	// events of a persisted window are dropped rather than persisting a partial recount
+	late := statsLateEvents.Value()
+	a.add(wantEvent(ts.Add(30*time.Second), "D", wantEntry(rawCID, pb.Message_Wantlist_Block, false)))
+	assert.Equal(t, late+1, statsLateEvents.Value())
+
+	closed = a.closeWindows(time.Time{})
+	assert.Len(t, closed, 1)
+	assert.Equal(t, 1, closed[0].Wants)
+}
+
+func TestStatsAggregator_Write(t *testing.T) {
+	conn := graphTest.Conn
+	defer conn.Do("DEL", "stats:windows", "stats:1674122400", "stats:1674122400:top_cids",
+		"stats:1674122400:cid_peers", "stats:1674122400:peer_wants", "stats:1674122400:codecs",
+		"stats:1674122400:cid_versions")
+
+	a := NewStatsAggregator(conn, time.Minute, 10, time.Hour)
+	ts := time.Date(2023, 1, 19, 10, 0, 0, 0, time.UTC)
+	assert.Nil(t, a.Write([]Event{
+		wantEvent(ts, "A", wantEntry(rawCID, pb.Message_Wantlist_Block, false)),
+		wantEvent(ts, "B", wantEntry(rawCID, pb.Message_Wantlist_Block, false)),
+	}))
+	assert.Nil(t, a.Close())
+
+	summary, err := redis.StringMap(conn.Do("HGETALL", "stats:1674122400"))
+	assert.Nil(t, err)
+	assert.Equal(t, "2", summary["wants"])
+	assert.Equal(t, "2", summary["peers"])
+	score, err := redis.Int(conn.Do("ZSCORE", "stats:1674122400:cid_peers", rawCID))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, score)
+	codecs, err := redis.IntMap(conn.Do("HGETALL", "stats:1674122400:codecs"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"raw": 2}, codecs)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+	pb "github.com/ipfs/go-unixfs/pb"
+)
+
+// unixfsProperties returns the properties that describe a UnixFS node on its block:
+//
+//	File, Raw    filesize and blocksizes (the sizes of the data below each link)
+//	Directory    entries (the names of the directory entries)
+//	HAMTShard    fanout and entries (the names of the entries stored in this shard, without bucket prefix)
+//	Symlink      target
+//	Metadata     mime_type
+//
+// DAG-PB nodes that are no UnixFS nodes (nil fsNode) have no properties.
+func unixfsProperties(fsNode *ft.FSNode, links []*format.Link) map[string]interface{} {
+	if fsNode == nil {
+		return map[string]interface{}{}
+	}
+	props := map[string]interface{}{"type": fsNode.Type().String()}
+	switch fsNode.Type() {
+	case pb.Data_File, pb.Data_Raw:
+		props["filesize"] = int(fsNode.FileSize())
+		blockSizes := make([]interface{}, len(fsNode.BlockSizes()))
+		for i, size := range fsNode.BlockSizes() {
+			blockSizes[i] = int(size)
+		}
+		props["blocksizes"] = blockSizes
+	case pb.Data_Directory:
+		entries := make([]interface{}, len(links))
+		for i, link := range links {
+			entries[i] = link.Name
+		}
+		props["entries"] = entries
+	case pb.Data_HAMTShard:
+		props["fanout"] = int(fsNode.Fanout())
+		entries := []interface{}{}
+		for _, link := range links {
+			if name, _ := shardEntry(fsNode, link.Name); name != "" {
+				entries = append(entries, name)
+			}
+		}
+		props["entries"] = entries
+	case pb.Data_Symlink:
+		props["target"] = string(fsNode.Data())
+	case pb.Data_Metadata:
+		if data, err := fsNode.GetBytes(); err == nil {
+			if metadata, err := ft.MetadataFromBytes(data); err == nil {
+				props["mime_type"] = metadata.MimeType
+			}
+		}
+	}
+	return props
+}
+
+// shardEntry splits the name of a link of a HAMT shard into the name of the directory entry and the
+// hex-encoded bucket prefix. Links to nested shards consist of the prefix only and have no entry name.
+func shardEntry(fsNode *ft.FSNode, linkName string) (name, prefix string) {
+	prefixLen := len(fmt.Sprintf("%X", fsNode.Fanout()-1))
+	if len(linkName) < prefixLen {
+		return "", linkName
+	}
+	return linkName[prefixLen:], linkName[:prefixLen]
+}
+
+// linkProperties returns the properties of the :has edges for the links of a block. Names of links in
+// HAMT shards are resolved to the names of the directory entries, with the bucket prefix kept separately.
+func linkProperties(fsNode *ft.FSNode, links []*format.Link) []map[string]interface{} {
+	props := make([]map[string]interface{}, len(links))
+	for i, link := range links {
+		props[i] = map[string]interface{}{
+			"index": i,
+			"name":  link.Name,
+			"size":  int(link.Size),
+		}
+		if fsNode != nil && fsNode.Type() == pb.Data_HAMTShard {
+			props[i]["name"], props[i]["bucket"] = shardEntry(fsNode, link.Name)
+		}
+	}
+	return props
+}
+
+// decodeDAG decodes a dag-pb block into its links and, if it is a UnixFS node, its FSNode. The FSNode is nil
+// for DAG-PB nodes whose payload is not UnixFS; only blocks that are no valid DAG-PB fail to decode.
+func decodeDAG(data []byte) (*ft.FSNode, []*format.Link, error) {
+	pn, err := merkledag.DecodeProtobuf(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	fsNode, err := ft.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return nil, pn.Links(), nil
+	}
+	return fsNode, pn.Links(), nil
+}
+
+// directoryEntries returns the CIDs of the entries of a directory or HAMT shard; nested shards are no entries.
+func directoryEntries(fsNode *ft.FSNode, links []*format.Link) []cid.Cid {
+	if fsNode == nil {
+		return nil
+	}
+	var entries []cid.Cid
+	for _, link := range links {
+		switch fsNode.Type() {
+		case pb.Data_Directory:
+			entries = append(entries, link.Cid)
+		case pb.Data_HAMTShard:
+			if name, _ := shardEntry(fsNode, link.Name); name != "" {
+				entries = append(entries, link.Cid)
+			}
+		}
+	}
+	return entries
+}
+
+// hasData reports whether a UnixFS node carries file data that is stored on disk.
+func hasData(fsNode *ft.FSNode) bool {
+	return fsNode != nil && (fsNode.Type() == pb.Data_File || fsNode.Type() == pb.Data_Raw) && len(fsNode.Data()) > 0
+}
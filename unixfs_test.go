@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+	pb "github.com/ipfs/go-unixfs/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func fsNodeFromBytes(t *testing.T, data []byte, err error) *ft.FSNode {
+	assert.Nil(t, err)
+	fsNode, err := ft.FSNodeFromBytes(data)
+	assert.Nil(t, err)
+	return fsNode
+}
+
+func TestUnixfsProperties(t *testing.T) {
+	t.Run("file", func(t *testing.T) {
+		fsNode := ft.NewFSNode(pb.Data_File)
+		fsNode.AddBlockSize(4)
+		fsNode.AddBlockSize(4)
+		fsNode.AddBlockSize(4)
+		assert.Equal(t, map[string]interface{}{
+			"type":       "File",
+			"filesize":   12,
+			"blocksizes": []interface{}{4, 4, 4},
+		}, unixfsProperties(fsNode, nil))
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		links := []*format.Link{{Name: "a.txt"}, {Name: "b.txt"}}
+		assert.Equal(t, map[string]interface{}{
+			"type":    "Directory",
+			"entries": []interface{}{"a.txt", "b.txt"},
+		}, unixfsProperties(ft.NewFSNode(pb.Data_Directory), links))
+	})
+
+	t.Run("HAMT shard", func(t *testing.T) {
+		data, err := ft.HAMTShardData([]byte{0x01}, 256, 0x22)
+		fsNode := fsNodeFromBytes(t, data, err)
+		links := []*format.Link{{Name: "0Aa.txt"}, {Name: "1F"}, {Name: "FFb.txt"}}
+		assert.Equal(t, map[string]interface{}{
+			"type":    "HAMTShard",
+			"fanout":  256,
+			"entries": []interface{}{"a.txt", "b.txt"},
+		}, unixfsProperties(fsNode, links))
+
+		props := linkProperties(fsNode, links)
+		assert.Equal(t, "a.txt", props[0]["name"])
+		assert.Equal(t, "0A", props[0]["bucket"])
+		assert.Equal(t, "", props[1]["name"], "nested shard")
+		assert.Equal(t, "1F", props[1]["bucket"])
+	})
+
+	t.Run("symlink", func(t *testing.T) {
+		data, err := ft.SymlinkData("../target")
+		assert.Equal(t, map[string]interface{}{
+			"type":   "Symlink",
+			"target": "../target",
+		}, unixfsProperties(fsNodeFromBytes(t, data, err), nil))
+	})
+
+	t.Run("metadata", func(t *testing.T) {
+		data, err := ft.BytesForMetadata(&ft.Metadata{MimeType: "text/plain"})
+		assert.Equal(t, map[string]interface{}{
+			"type":      "Metadata",
+			"mime_type": "text/plain",
+		}, unixfsProperties(fsNodeFromBytes(t, data, err), nil))
+	})
+}
+
+func TestLinkProperties(t *testing.T) {
+	links := []*format.Link{
+		{Name: "", Size: 4, Cid: cid.MustParse(rawCID)},
+		{Name: "", Size: 4, Cid: cid.MustParse(rawCID)},
+	}
+	props := linkProperties(ft.NewFSNode(pb.Data_File), links)
+	assert.Equal(t, []map[string]interface{}{
+		{"index": 0, "name": "", "size": 4},
+		{"index": 1, "name": "", "size": 4},
+	}, props)
+	// all values can be encoded for the graph
+	assert.NotPanics(t, func() { encodeProperties(props[0]) })
+}
+
+func TestDecodeDAG(t *testing.T) {
+	data, err := hex.DecodeString(fileBlock)
+	assert.Nil(t, err)
+	fsNode, links, err := decodeDAG(data)
+	assert.Nil(t, err)
+	assert.Equal(t, pb.Data_File, fsNode.Type())
+	assert.Equal(t, []uint64{4, 4, 4}, fsNode.BlockSizes())
+	assert.Len(t, links, 3)
+	assert.Equal(t, cid.MustParse(otherRawCID), links[2].Cid)
+
+	_, _, err = decodeDAG([]byte{0xFF})
+	assert.Error(t, err)
+
+	// DAG-PB nodes without a UnixFS payload keep their links
+	pn := merkledag.NodeWithData(nil)
+	assert.Nil(t, pn.AddRawLink("chunk", &format.Link{Cid: cid.MustParse(rawCID), Size: 4}))
+	data, err = pn.EncodeProtobuf(false)
+	assert.Nil(t, err)
+	fsNode, links, err = decodeDAG(data)
+	assert.Nil(t, err)
+	assert.Nil(t, fsNode)
+	assert.Len(t, links, 1)
+	assert.Empty(t, unixfsProperties(fsNode, links))
+	assert.Empty(t, directoryEntries(fsNode, links))
+	assert.False(t, hasData(fsNode))
+}
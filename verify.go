@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	_ "github.com/multiformats/go-multihash/register/all"
+)
+
+// hashMismatches counts the blocks that were rejected because their data does not match their CID.
+var hashMismatches = expvar.NewInt("hash_mismatches")
+
+// unverifiedBlocks counts the blocks that were accepted without verification because their data could not be
+// hashed, e.g. with a multihash function that is not supported.
+var unverifiedBlocks = expvar.NewInt("unverified_blocks")
+
+// errHashMismatch is returned for blocks whose data does not hash to the multihash of their CID.
+var errHashMismatch = errors.New("hash mismatch")
+
+// verifyBlock re-hashes the data of a block with the multihash function of its CID (sha2-256, blake2b, blake3,
+// sha3 and others) and compares the result to the CID.
+func verifyBlock(_cid cid.Cid, data []byte) error {
+	sum, err := _cid.Prefix().Sum(data)
+	if err != nil {
+		return fmt.Errorf("error hashing CID %s: %w", _cid.String(), err)
+	}
+	if !bytes.Equal(sum.Hash(), _cid.Hash()) {
+		return fmt.Errorf("%w: data of CID %s hashes to %s", errHashMismatch, _cid.String(), sum.Hash().B58String())
+	}
+	return nil
+}
+
+// checkBlock verifies a retrieved block and returns errHashMismatch if it does not match its CID. Blocks that
+// cannot be hashed are accepted, but counted in unverifiedBlocks.
+func checkBlock(_cid cid.Cid, data []byte) error {
+	err := verifyBlock(_cid, data)
+	if errors.Is(err, errHashMismatch) {
+		return err
+	} else if err != nil {
+		unverifiedBlocks.Add(1)
+		log.Printf("Accepting CID %s unverified: %v", _cid.String(), err)
+	}
+	return nil
+}
+
+// storedEncoded reports whether the data file of a block holds the block as it is encoded, such that it can be
+// verified against the CID. DAG-PB leaves are stored as the file data that they carry.
+func storedEncoded(_cid cid.Cid) bool {
+	return _cid.Type() != cid.DagProtobuf
+}
+
+// dataHashSuffix is appended to the name of the data file of a block that is not stored as it is encoded to name
+// the file that holds the hex-encoded SHA-256 of the stored data, such that it can be verified offline.
+const dataHashSuffix = ".sha256"
+
+// dataHash returns the hex-encoded SHA-256 of the stored data of a block.
+func dataHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyStoredData compares the stored data of a block that is not stored as it is encoded to the hash recorded
+// next to it. It returns an error satisfying os.ErrNotExist if no hash was recorded.
+func verifyStoredData(dir string, _cid cid.Cid, data []byte) error {
+	recorded, err := os.ReadFile(filepath.Join(dir, _cid.String()+dataHashSuffix))
+	if err != nil {
+		return err
+	}
+	if sum := dataHash(data); sum != strings.TrimSpace(string(recorded)) {
+		return fmt.Errorf("%w: stored data of CID %s hashes to %s", errHashMismatch, _cid.String(), sum)
+	}
+	return nil
+}
+
+// rejectBlock records on the node of a block that its data did not match the CID and fails the block, so that
+// it is retrieved again.
+func (f *IPFSFetcher) rejectBlock(t *traversal, _cid cid.Cid, cause error) {
+	hashMismatches.Add(1)
+	if _, err := f.graph.Query(fmt.Sprintf(
+		"MATCH (b:Block {cid: '%s'}) SET b.hash_mismatches = coalesce(b.hash_mismatches, 0) + 1", _cid.String(),
+	)); err != nil {
+		log.Fatalf("failed to record hash mismatch of CID %s: %v", _cid.String(), err)
+	}
+	f.fail(t, _cid, cause)
+}
+
+// BlockError is a block in the data folder that failed verification, along with the reason.
+type BlockError struct {
+	Cid cid.Cid
+	Err error
+}
+
+// verifyDataDir re-hashes the blocks stored in dir. Blocks that are not stored as they are encoded are compared
+// to the hash recorded next to them. Files that are not named by a CID and blocks without a recorded hash are skipped.
+// Blocks whose data does not match are corrupt, whereas blocks that cannot be hashed, e.g. with a multihash function
+// that is not supported, are unverifiable, like the blocks that were stored unverified in the first place.
+func verifyDataDir(dir string) (verified, skipped int, unverifiable, corrupt []BlockError, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0, nil, nil, err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), dataHashSuffix) {
+			// recorded hashes are checked along with their block
+			continue
+		}
+		_cid, err := cid.Parse(entry.Name())
+		if entry.IsDir() || err != nil {
+			skipped++
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return verified, skipped, unverifiable, corrupt, err
+		}
+		if storedEncoded(_cid) {
+			err = verifyBlock(_cid, data)
+		} else if err = verifyStoredData(dir, _cid, data); errors.Is(err, os.ErrNotExist) {
+			// stored before hashes were recorded
+			skipped++
+			continue
+		}
+		if errors.Is(err, errHashMismatch) {
+			corrupt = append(corrupt, BlockError{_cid, err})
+			continue
+		} else if err != nil {
+			unverifiable = append(unverifiable, BlockError{_cid, err})
+			continue
+		}
+		verified++
+	}
+	return verified, skipped, unverifiable, corrupt, nil
+}
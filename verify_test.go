@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/korovkin/limiter"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyBlock(t *testing.T) {
+	node := NewMockIPFSNode()
+	for _, c := range []string{rawCID, otherRawCID, yetAnotherRawCID, fileCID, directoryCID, cborCID, gitCID, ethBlockCID} {
+		data, err := node.GetBlock(cid.MustParse(c))
+		assert.Nil(t, err)
+		assert.Nil(t, verifyBlock(cid.MustParse(c), data), c)
+	}
+
+	// blake2b-256
+	assert.ErrorIs(t, verifyBlock(cid.MustParse(yetAnotherRawCID), []byte{0xFF, 0xFF, 0xFF, 0xFF}), errHashMismatch)
+	// sha2-256
+	assert.ErrorIs(t, verifyBlock(cid.MustParse(rawCID), []byte{0xFF, 0x00, 0xFF, 0x00}), errHashMismatch)
+
+	for _, code := range []uint64{mh.BLAKE3, mh.SHA3_256, mh.SHA2_512} {
+		_cid, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: code, MhLength: -1}.Sum([]byte("data"))
+		assert.Nil(t, err)
+		assert.Nil(t, verifyBlock(_cid, []byte("data")))
+		assert.ErrorIs(t, verifyBlock(_cid, []byte("date")), errHashMismatch)
+	}
+}
+
+func TestCheckBlock(t *testing.T) {
+	unverified := unverifiedBlocks.Value()
+	assert.ErrorIs(t, checkBlock(cid.MustParse(rawCID), []byte{0xFF, 0x00, 0xFF, 0x00}), errHashMismatch)
+	assert.Equal(t, unverified, unverifiedBlocks.Value())
+
+	// blocks hashed with an unsupported function are accepted, but counted
+	hash, err := mh.Encode([]byte("digest"), 0x300000)
+	assert.Nil(t, err)
+	assert.Nil(t, checkBlock(cid.NewCidV1(cid.Raw, hash), []byte("data")))
+	assert.Equal(t, unverified+1, unverifiedBlocks.Value())
+}
+
+func TestVerifyDataDir(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, rawCID), []byte{0x00, 0xFF, 0x00, 0xFF}, 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, otherRawCID), []byte{0x00, 0x00, 0x00, 0x00}, 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, directoryCID), []byte("file data"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644))
+
+	verified, skipped, unverifiable, corrupt, err := verifyDataDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, verified)
+	assert.Equal(t, 2, skipped)
+	assert.Empty(t, unverifiable)
+	assert.Len(t, corrupt, 1)
+	assert.Equal(t, cid.MustParse(otherRawCID), corrupt[0].Cid)
+	assert.ErrorIs(t, corrupt[0].Err, errHashMismatch)
+
+	t.Run("DAG-PB leaves are compared to their recorded hash", func(t *testing.T) {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, directoryCID+dataHashSuffix), []byte(dataHash([]byte("file data"))), 0644))
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, fileCID), []byte("tampered"), 0644))
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, fileCID+dataHashSuffix), []byte(dataHash([]byte("file data"))), 0644))
+
+		verified, skipped, unverifiable, corrupt, err := verifyDataDir(dir)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, verified)
+		assert.Equal(t, 1, skipped)
+		assert.Empty(t, unverifiable)
+		assert.Len(t, corrupt, 2)
+		for _, block := range corrupt {
+			assert.ErrorIs(t, block.Err, errHashMismatch)
+		}
+	})
+
+	t.Run("blocks hashed with an unsupported function are unverifiable", func(t *testing.T) {
+		hash, err := mh.Encode([]byte("digest"), 0x300000)
+		assert.Nil(t, err)
+		_cid := cid.NewCidV1(cid.Raw, hash)
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, _cid.String()), []byte("data"), 0644))
+
+		verified, _, unverifiable, corrupt, err := verifyDataDir(dir)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, verified)
+		assert.Len(t, corrupt, 2)
+		assert.Len(t, unverifiable, 1)
+		assert.Equal(t, _cid, unverifiable[0].Cid)
+		assert.NotErrorIs(t, unverifiable[0].Err, errHashMismatch)
+	})
+}
+
+func TestIPFSFetcher_SaveRawObject(t *testing.T) {
+	dir := t.TempDir()
+	fetcher := &IPFSFetcher{DownloadPath: dir}
+	assert.Nil(t, fetcher.SaveRawObject(cid.MustParse(fileCID), []byte("file data")))
+
+	verified, _, _, corrupt, err := verifyDataDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, verified)
+	assert.Empty(t, corrupt)
+}
+
+// corruptIPFSNode returns wrong data for otherRawCID.
+type corruptIPFSNode struct {
+	IPFSNode
+}
+
+func (n *corruptIPFSNode) GetFile(_cid cid.Cid) ([]byte, error) {
+	if _cid.String() == otherRawCID {
+		return []byte{0x00, 0x00, 0x00, 0x00}, nil
+	}
+	return n.IPFSNode.GetFile(_cid)
+}
+
+func TestIPFSFetcher_HashMismatch(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+
+	mismatches := hashMismatches.Value()
+	fetcher := NewIPFSFetcher(context.Background(), &corruptIPFSNode{NewMockIPFSNode()}, graphPoolTest, ipfsTestDataPath, FetchLimits{Workers: 2, Network: 2})
+	jobs = limiter.NewConcurrencyLimiter(1)
+	fetcher.Download(cid.MustParse(fileCID), "")
+	jobs.WaitAndClose()
+
+	assert.Equal(t, mismatches+1, hashMismatches.Value())
+	_, err := os.Stat(filepath.Join(ipfsTestDataPath, otherRawCID))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	res, err := graphTest.Query(fmt.Sprintf(
+		"MATCH (b:Block { cid: '%s' }), (f:Block { cid: '%s' }) RETURN b.state, b.hash_mismatches, f.state",
+		otherRawCID, fileCID,
+	))
+	assert.Nil(t, err)
+	assert.True(t, res.Next())
+	assert.Equal(t, []interface{}{StateFailed, 1, StateExpanded}, res.Record().Values())
+}
+
+// corruptDAGIPFSNode returns the block of directoryCID for fileCID.
+type corruptDAGIPFSNode struct {
+	IPFSNode
+}
+
+func (n *corruptDAGIPFSNode) GetBlock(_cid cid.Cid) ([]byte, error) {
+	if _cid.String() == fileCID {
+		return n.IPFSNode.GetBlock(cid.MustParse(directoryCID))
+	}
+	return n.IPFSNode.GetBlock(_cid)
+}
+
+func TestIPFSFetcher_DAGHashMismatch(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+
+	mismatches := hashMismatches.Value()
+	fetcher := NewIPFSFetcher(context.Background(), &corruptDAGIPFSNode{NewMockIPFSNode()}, graphPoolTest, ipfsTestDataPath, FetchLimits{Workers: 2, Network: 2})
+	jobs = limiter.NewConcurrencyLimiter(1)
+	fetcher.Download(cid.MustParse(fileCID), "")
+	jobs.WaitAndClose()
+
+	assert.Equal(t, mismatches+1, hashMismatches.Value())
+	res, err := graphTest.Query(fmt.Sprintf(
+		"MATCH (f:Block { cid: '%s' }) OPTIONAL MATCH (f)-[:has]->(c:Block) RETURN f.state, f.hash_mismatches, count(c)",
+		fileCID,
+	))
+	assert.Nil(t, err)
+	assert.True(t, res.Next())
+	assert.Equal(t, []interface{}{StateFailed, 1, 0}, res.Record().Values())
+}
+
+// corruptIPLDIPFSNode returns the block of gitCID for cborCID.
+type corruptIPLDIPFSNode struct {
+	IPFSNode
+}
+
+func (n *corruptIPLDIPFSNode) GetBlock(_cid cid.Cid) ([]byte, error) {
+	if _cid.String() == cborCID {
+		return n.IPFSNode.GetBlock(cid.MustParse(gitCID))
+	}
+	return n.IPFSNode.GetBlock(_cid)
+}
+
+func TestIPFSFetcher_IPLDHashMismatch(t *testing.T) {
+	if err := os.Mkdir(ipfsTestDataPath, os.ModePerm); err != nil && !errors.Is(err, os.ErrExist) {
+		panic(err)
+	}
+	defer os.RemoveAll(ipfsTestDataPath)
+	defer graphTest.Query("MATCH (b:Block) DELETE b")
+
+	mismatches := hashMismatches.Value()
+	fetcher := NewIPFSFetcher(context.Background(), &corruptIPLDIPFSNode{NewMockIPFSNode()}, graphPoolTest, ipfsTestDataPath, FetchLimits{Workers: 2, Network: 2})
+	jobs = limiter.NewConcurrencyLimiter(1)
+	fetcher.Download(cid.MustParse(cborCID), "")
+	jobs.WaitAndClose()
+
+	// the links of a block that does not match its CID are not followed
+	assert.Equal(t, mismatches+1, hashMismatches.Value())
+	res, err := graphTest.Query(fmt.Sprintf(
+		"MATCH (b:Block { cid: '%s' }) OPTIONAL MATCH (b)-[:has]->(c:Block) RETURN b.state, b.kind, count(c)",
+		cborCID,
+	))
+	assert.Nil(t, err)
+	assert.True(t, res.Next())
+	assert.Equal(t, []interface{}{StateFailed, nil, 0}, res.Record().Values())
+}